@@ -1,19 +1,64 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"strings"
+	"time"
 
+	"github.com/bigkevmcd/migrator/pkg/api/v1alpha1"
 	"github.com/bigkevmcd/migrator/pkg/migrator"
 	"github.com/spf13/cobra"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/client/config"
 )
 
+// stateFlags configures where the state of migrations is stored in the
+// cluster.
+type stateFlags struct {
+	name      string
+	namespace string
+}
+
+func (s *stateFlags) options(kubeClient client.Client) []migrator.Option {
+	return []migrator.Option{
+		migrator.WithStateStore(migrator.NewConfigMapStateStore(kubeClient, client.ObjectKey{
+			Name:      s.name,
+			Namespace: s.namespace,
+		})),
+		migrator.WithInversePatchStore(migrator.NewSecretInversePatchStore(kubeClient, s.namespace)),
+	}
+}
+
+func (s *stateFlags) snapshotStore(kubeClient client.Client) migrator.Option {
+	return migrator.WithSnapshotStore(migrator.NewSecretSnapshotStore(kubeClient, s.namespace))
+}
+
 func newRootCmd() *cobra.Command {
 	var (
 		migrationsPath string
+		targetDir      string
 		direction      string
+		dryRun         string
+		fieldManager   string
+		downTo         string
+		downSteps      int
+		retries        int
+		batchSize      int
+		concurrency    int
+		rateLimit      float64
+		noLock         bool
+		disallowGaps   bool
+		records        bool
+		forceConflicts bool
+		keepGoing      bool
+		atomic         bool
+		snapshot       bool
+		vars           map[string]string
+		scriptTimeout  time.Duration
+		state          stateFlags
 	)
 
 	cmd := cobra.Command{
@@ -24,30 +69,118 @@ func newRootCmd() *cobra.Command {
 				return fmt.Errorf("%s is not a valid migration direction", direction)
 			}
 
+			if direction != "down" && (downTo != "" || downSteps != 0) {
+				return errors.New("--to and --steps can only be used when migrating down")
+			}
+
+			dryRun = strings.ToLower(dryRun)
+			if !(dryRun == "none" || dryRun == "client" || dryRun == "server") {
+				return fmt.Errorf("%s is not a valid dry-run mode", dryRun)
+			}
+
+			if retries < 0 {
+				return errors.New("--conflict-retries cannot be negative")
+			}
+
+			if targetDir != "" {
+				if dryRun == "server" {
+					return errors.New("--dry-run=server cannot be used with --target-dir")
+				}
+				for _, name := range []string{
+					"keep-going", "atomic", "migration-records", "snapshot", "field-manager", "force-conflicts",
+					"conflict-retries", "no-optimistic-lock", "batch-size", "concurrency", "rate-limit",
+				} {
+					if cmd.Flags().Changed(name) {
+						return fmt.Errorf("--%s cannot be used with --target-dir", name)
+					}
+				}
+			}
+
 			return nil
 		},
 		RunE: func(cmd *cobra.Command, args []string) error {
+			var parseOpts []migrator.ParseOption
+			if disallowGaps {
+				parseOpts = append(parseOpts, migrator.DisallowGaps())
+			}
 
-			parsed, err := migrator.ParseDirectory(migrationsPath)
+			parsed, err := migrator.ParseDirectory(migrationsPath, parseOpts...)
 			if err != nil {
 				return err
 			}
 
-			cfg, err := config.GetConfig()
-			if err != nil {
-				return err
+			if targetDir != "" {
+				dirOpts := []migrator.Option{
+					migrator.WithOutput(cmd.OutOrStdout()),
+					migrator.WithApplyOptions(migrator.WithVariables(vars), migrator.WithScriptTimeout(scriptTimeout)),
+				}
+				if dryRun != "none" {
+					dirOpts = append(dirOpts, migrator.WithDryRun(migrator.DryRun(dryRun)))
+				}
+				if downTo != "" {
+					dirOpts = append(dirOpts, migrator.WithDownTo(downTo))
+				}
+				if downSteps > 0 {
+					dirOpts = append(dirOpts, migrator.WithDownSteps(downSteps))
+				}
+				switch direction {
+				case "up":
+					return migrator.MigrateDirectoryUp(targetDir, parsed, dirOpts...)
+				case "down":
+					return migrator.MigrateDirectoryDown(targetDir, parsed, dirOpts...)
+				}
 			}
 
-			kubeClient, err := client.New(cfg, client.Options{})
+			kubeClient, err := newKubeClient()
 			if err != nil {
 				return err
 			}
 
+			opts := state.options(kubeClient)
+			opts = append(opts,
+				migrator.WithOutput(cmd.OutOrStdout()),
+				migrator.WithFieldManager(fieldManager),
+				migrator.WithConflictRetries(retries),
+				migrator.WithBatchSize(batchSize),
+				migrator.WithConcurrency(concurrency),
+				migrator.WithProgress(cmd.ErrOrStderr()),
+				migrator.WithApplyOptions(migrator.WithVariables(vars), migrator.WithScriptTimeout(scriptTimeout)))
+			if rateLimit > 0 {
+				opts = append(opts, migrator.WithRateLimit(rateLimit, max(concurrency, 1)))
+			}
+			if noLock {
+				opts = append(opts, migrator.WithoutOptimisticLock())
+			}
+			if dryRun != "none" {
+				opts = append(opts, migrator.WithDryRun(migrator.DryRun(dryRun)))
+			}
+			if records {
+				opts = append(opts, migrator.WithMigrationRecords())
+			}
+			if forceConflicts {
+				opts = append(opts, migrator.WithForceConflicts())
+			}
+			if keepGoing {
+				opts = append(opts, migrator.WithKeepGoing())
+			}
+			if atomic {
+				opts = append(opts, migrator.WithAtomic())
+			}
+			if snapshot {
+				opts = append(opts, state.snapshotStore(kubeClient))
+			}
+			if downTo != "" {
+				opts = append(opts, migrator.WithDownTo(downTo))
+			}
+			if downSteps > 0 {
+				opts = append(opts, migrator.WithDownSteps(downSteps))
+			}
+
 			switch direction {
 			case "up":
-				return migrator.MigrateUp(cmd.Context(), kubeClient, parsed)
+				return migrator.MigrateUp(cmd.Context(), kubeClient, parsed, opts...)
 			case "down":
-				return migrator.MigrateDown(cmd.Context(), kubeClient, parsed)
+				return migrator.MigrateDown(cmd.Context(), kubeClient, parsed, opts...)
 			}
 
 			return nil
@@ -57,11 +190,166 @@ func newRootCmd() *cobra.Command {
 	cmd.Flags().StringVar(&migrationsPath, "migrations-dir", "", "Path to migrations to apply")
 	cobra.CheckErr(cmd.MarkFlagRequired("migrations-dir"))
 
+	cmd.Flags().BoolVar(&disallowGaps, "disallow-gaps", false, "Fail if the migration versions are not consecutive")
+	cmd.Flags().StringVar(&targetDir, "target-dir", "", "Path to a directory of manifests to migrate instead of the cluster")
 	cmd.Flags().StringVar(&direction, "direction", "up", "Direction - up or down")
+	cmd.Flags().StringVar(&downTo, "to", "", "When migrating down, roll back the migrations applied after this migration")
+	cmd.Flags().IntVar(&downSteps, "steps", 0, "When migrating down, roll back this many of the applied migrations")
+	cmd.Flags().StringVar(&dryRun, "dry-run", "none", "Dry-run mode - none, client or server")
+	cmd.Flags().StringVar(&fieldManager, "field-manager", "migrator", "Name of the field manager that owns the fields changed by the migrations")
+	cmd.Flags().BoolVar(&forceConflicts, "force-conflicts", false, "Take ownership of fields owned by other field managers when applying server-side apply patches")
+	cmd.Flags().IntVar(&retries, "conflict-retries", 5, "Number of times to retry patching a resource that changes while it is being migrated")
+	cmd.Flags().BoolVar(&noLock, "no-optimistic-lock", false, "Patch resources even if they change while they are being migrated")
+	cmd.Flags().IntVar(&batchSize, "batch-size", 0, "Number of resources to list and patch in each batch, 0 patches all resources in one batch")
+	cmd.Flags().IntVar(&concurrency, "concurrency", 1, "Number of resources in a batch to patch in parallel")
+	cmd.Flags().Float64Var(&rateLimit, "rate-limit", 0, "Maximum number of patches per second, 0 is unlimited")
+	cmd.Flags().BoolVar(&keepGoing, "keep-going", false, "Continue migrating the remaining resources when a resource fails to migrate")
+	cmd.Flags().BoolVar(&atomic, "atomic", false, "Restore the resources patched by a migration if any resource fails to migrate")
+	cmd.Flags().StringToStringVar(&vars, "set", nil, "Variables for templated patches, e.g. --set env=production")
+	cmd.Flags().DurationVar(&scriptTimeout, "script-timeout", 5*time.Second, "Maximum time that a Starlark patch can run for on each resource")
+	cmd.Flags().BoolVar(&snapshot, "snapshot", false, "Store the resources in Secrets before they are migrated so that they can be restored with rollback")
+	cmd.Flags().BoolVar(&records, "migration-records", false, "Create a MigrationRecord for each migration that is applied")
+	cmd.PersistentFlags().StringVar(&state.name, "state-name", "migrator-state", "Name of the ConfigMap used to record applied migrations")
+	cmd.PersistentFlags().StringVar(&state.namespace, "state-namespace", "default", "Namespace used to store the state of applied migrations")
+
+	cmd.AddCommand(newRollbackCmd(&state))
+	cmd.AddCommand(newDiffCmd(&state))
+	cmd.AddCommand(newValidateCmd())
+	cmd.AddCommand(newImportCmd())
 
 	return &cmd
 }
 
+func newRollbackCmd(state *stateFlags) *cobra.Command {
+	return &cobra.Command{
+		Use:   "rollback <migration-name>",
+		Short: "Restore the resources patched by a migration to their original versions",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			kubeClient, err := newKubeClient()
+			if err != nil {
+				return err
+			}
+
+			opts := append(state.options(kubeClient), state.snapshotStore(kubeClient))
+
+			return migrator.Rollback(cmd.Context(), kubeClient, args[0], opts...)
+		},
+	}
+}
+
+func newDiffCmd(state *stateFlags) *cobra.Command {
+	var (
+		migrationsPath string
+		targetDir      string
+		noColor        bool
+		vars           map[string]string
+		scriptTimeout  time.Duration
+	)
+
+	cmd := &cobra.Command{
+		Use:   "diff",
+		Short: "Show the changes that the migrations would make",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			parsed, err := migrator.ParseDirectory(migrationsPath)
+			if err != nil {
+				return err
+			}
+
+			opts := []migrator.Option{migrator.WithApplyOptions(migrator.WithVariables(vars), migrator.WithScriptTimeout(scriptTimeout))}
+			if !noColor {
+				opts = append(opts, migrator.WithColor())
+			}
+
+			if targetDir != "" {
+				return migrator.DiffDirectory(targetDir, parsed, cmd.OutOrStdout(), opts...)
+			}
+
+			kubeClient, err := newKubeClient()
+			if err != nil {
+				return err
+			}
+
+			opts = append(opts, state.options(kubeClient)...)
+
+			return migrator.Diff(cmd.Context(), kubeClient, parsed, cmd.OutOrStdout(), opts...)
+		},
+	}
+
+	cmd.Flags().StringVar(&migrationsPath, "migrations-dir", "", "Path to migrations to diff")
+	cobra.CheckErr(cmd.MarkFlagRequired("migrations-dir"))
+
+	cmd.Flags().StringVar(&targetDir, "target-dir", "", "Path to a directory of manifests to diff instead of the cluster")
+	cmd.Flags().BoolVar(&noColor, "no-color", false, "Disable coloured output")
+	cmd.Flags().StringToStringVar(&vars, "set", nil, "Variables for templated patches, e.g. --set env=production")
+	cmd.Flags().DurationVar(&scriptTimeout, "script-timeout", 5*time.Second, "Maximum time that a Starlark patch can run for on each resource")
+
+	return cmd
+}
+
+func newValidateCmd() *cobra.Command {
+	var migrationsPath string
+
+	cmd := &cobra.Command{
+		Use:   "validate",
+		Short: "Validate the migration files in a directory",
+		// Problems in the migration files are not usage errors.
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return migrator.ValidateDirectory(migrationsPath)
+		},
+	}
+
+	cmd.Flags().StringVar(&migrationsPath, "migrations-dir", "", "Path to migrations to validate")
+	cobra.CheckErr(cmd.MarkFlagRequired("migrations-dir"))
+
+	return cmd
+}
+
+func newImportCmd() *cobra.Command {
+	var migrationsPath string
+
+	cmd := &cobra.Command{
+		Use:   "import <kustomization.yaml>",
+		Short: "Convert the patches in a kustomization file to migrations",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			filenames, err := migrator.ImportKustomization(args[0], migrationsPath)
+			if err != nil {
+				return err
+			}
+
+			for _, filename := range filenames {
+				fmt.Fprintf(cmd.OutOrStdout(), "created %s\n", filename)
+			}
+
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&migrationsPath, "migrations-dir", "", "Path to write the migrations to")
+	cobra.CheckErr(cmd.MarkFlagRequired("migrations-dir"))
+
+	return cmd
+}
+
+func newKubeClient() (client.Client, error) {
+	cfg, err := config.GetConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		return nil, err
+	}
+	if err := v1alpha1.AddToScheme(scheme); err != nil {
+		return nil, err
+	}
+
+	return client.New(cfg, client.Options{Scheme: scheme})
+}
+
 func main() {
 	cobra.CheckErr(newRootCmd().Execute())
 }
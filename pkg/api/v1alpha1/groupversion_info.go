@@ -0,0 +1,24 @@
+//go:generate go run sigs.k8s.io/controller-tools/cmd/controller-gen@v0.16.5 object paths="./..."
+//go:generate go run sigs.k8s.io/controller-tools/cmd/controller-gen@v0.16.5 crd paths="./..." output:crd:artifacts:config=../../../config/crd/bases
+
+// Package v1alpha1 contains API Schema definitions for the migrator v1alpha1
+// API group.
+// +kubebuilder:object:generate=true
+// +groupName=migrator.gitops.tools
+package v1alpha1
+
+import (
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/scheme"
+)
+
+var (
+	// GroupVersion is group version used to register these objects.
+	GroupVersion = schema.GroupVersion{Group: "migrator.gitops.tools", Version: "v1alpha1"}
+
+	// SchemeBuilder is used to add go types to the GroupVersionKind scheme.
+	SchemeBuilder = &scheme.Builder{GroupVersion: GroupVersion}
+
+	// AddToScheme adds the types in this group-version to the given scheme.
+	AddToScheme = SchemeBuilder.AddToScheme
+)
@@ -0,0 +1,106 @@
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Direction is the direction that a migration was applied in.
+// +kubebuilder:validation:Enum=Up;Down
+type Direction string
+
+const (
+	// DirectionUp indicates that the Up patches were applied.
+	DirectionUp Direction = "Up"
+	// DirectionDown indicates that the Down patches were applied.
+	DirectionDown Direction = "Down"
+)
+
+// Outcome is the result of applying a migration.
+// +kubebuilder:validation:Enum=InProgress;Succeeded;Failed
+type Outcome string
+
+const (
+	// OutcomeInProgress indicates that the migration is still being applied.
+	OutcomeInProgress Outcome = "InProgress"
+	// OutcomeSucceeded indicates that all resources were migrated.
+	OutcomeSucceeded Outcome = "Succeeded"
+	// OutcomeFailed indicates that the migration failed.
+	OutcomeFailed Outcome = "Failed"
+)
+
+// MigratedResource identifies a resource that was patched by a migration.
+type MigratedResource struct {
+	Group           string `json:"group,omitempty"`
+	Version         string `json:"version"`
+	Kind            string `json:"kind"`
+	Namespace       string `json:"namespace,omitempty"`
+	Name            string `json:"name"`
+	ResourceVersion string `json:"resourceVersion,omitempty"`
+}
+
+// MigrationRecordSpec describes a single run of a migration.
+type MigrationRecordSpec struct {
+	// Migration is the name of the migration that was applied.
+	Migration string `json:"migration"`
+
+	// Filename is the file that the migration was parsed from.
+	// +optional
+	Filename string `json:"filename,omitempty"`
+
+	// Direction is the direction the migration was applied in.
+	Direction Direction `json:"direction"`
+
+	// Resources are the resources that were patched by the migration, only
+	// the first 1000 are listed to keep the record within the size limit of
+	// a resource.
+	// +optional
+	Resources []MigratedResource `json:"resources,omitempty"`
+
+	// ResourceCount is the number of resources that were patched by the
+	// migration.
+	// +optional
+	ResourceCount int `json:"resourceCount,omitempty"`
+
+	// Outcome is the result of applying the migration.
+	Outcome Outcome `json:"outcome"`
+
+	// Message describes the failure when the Outcome is Failed.
+	// +optional
+	Message string `json:"message,omitempty"`
+
+	// StartedAt is when the migration started.
+	StartedAt metav1.Time `json:"startedAt"`
+
+	// CompletedAt is when the migration completed.
+	// +optional
+	CompletedAt *metav1.Time `json:"completedAt,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:scope=Cluster
+// +kubebuilder:printcolumn:name="Migration",type=string,JSONPath=`.spec.migration`
+// +kubebuilder:printcolumn:name="Direction",type=string,JSONPath=`.spec.direction`
+// +kubebuilder:printcolumn:name="Outcome",type=string,JSONPath=`.spec.outcome`
+// +kubebuilder:printcolumn:name="Resources",type=integer,JSONPath=`.spec.resourceCount`
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// MigrationRecord is the audit record of a migration being applied.
+type MigrationRecord struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec MigrationRecordSpec `json:"spec,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// MigrationRecordList contains a list of MigrationRecord.
+type MigrationRecordList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []MigrationRecord `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&MigrationRecord{}, &MigrationRecordList{})
+}
@@ -1,32 +1,100 @@
 package migrator
 
 import (
+	"encoding/json"
 	"fmt"
+	"strconv"
+	"strings"
+	"time"
 
 	jsonpatch "github.com/evanphx/json-patch/v5"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/kube-openapi/pkg/util/proto"
+	"sigs.k8s.io/yaml"
 )
 
 const (
-	mergePatchType = "application/merge-patch+json"
-	jsonPatchType  = "application/json-patch+json"
+	mergePatchType          = "application/merge-patch+json"
+	jsonPatchType           = "application/json-patch+json"
+	strategicMergePatchType = "application/strategic-merge-patch+json"
+	applyPatchType          = "application/apply-patch+yaml"
+	celPatchType            = "application/cel"
+	starlarkPatchType       = "application/starlark"
 )
 
+// ApplyOption configures how patches are applied.
+type ApplyOption func(*applyOptions)
+
+type applyOptions struct {
+	openAPIModels proto.Models
+	vars          map[string]string
+	scriptTimeout time.Duration
+}
+
+// WithOpenAPIModels configures the OpenAPI models used to find the patch
+// strategies for resources that are not built-in types, e.g. custom resources.
+func WithOpenAPIModels(m proto.Models) ApplyOption {
+	return func(o *applyOptions) {
+		o.openAPIModels = m
+	}
+}
+
+func newApplyOptions(opts []ApplyOption) applyOptions {
+	var o applyOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	return o
+}
+
 // ApplyPatches applies a set of "patches" to a resource.
 //
 // A copy of the resource is returned with the patches applied.
-func ApplyPatches(obj *unstructured.Unstructured, patches []Patch) (*unstructured.Unstructured, error) {
+func ApplyPatches(obj *unstructured.Unstructured, patches []Patch, opts ...ApplyOption) (*unstructured.Unstructured, error) {
+	o := newApplyOptions(opts)
+
 	objCopy := obj.DeepCopy() // DeepCopy requires a pointer to obj
 	var err error
 	for _, patch := range patches {
+		if patch.Template {
+			patch, err = renderPatch(patch, objCopy, o.vars)
+			if err != nil {
+				return nil, err
+			}
+		}
+
 		switch patch.Type {
 		case jsonPatchType:
-			objCopy, err = applyJSONPatch(objCopy, patch.Change)
+			objCopy, err = applyJSONPatch(objCopy, patch)
 			if err != nil {
 				return nil, err
 			}
 		case mergePatchType:
-			objCopy, err = applyMergePatch(objCopy, patch.Change)
+			objCopy, err = applyMergePatch(objCopy, patch)
+			if err != nil {
+				return nil, err
+			}
+		case strategicMergePatchType:
+			objCopy, err = applyStrategicMergePatch(objCopy, patch, &o)
+			if err != nil {
+				return nil, err
+			}
+		case applyPatchType:
+			objCopy, err = applyApplyPatch(objCopy, patch, &o)
+			if err != nil {
+				return nil, err
+			}
+		case celPatchType:
+			objCopy, err = applyCELPatch(objCopy, patch, &o)
+			if err != nil {
+				return nil, err
+			}
+		case starlarkPatchType:
+			objCopy, err = applyStarlarkPatch(objCopy, patch, &o)
 			if err != nil {
 				return nil, err
 			}
@@ -38,8 +106,88 @@ func ApplyPatches(obj *unstructured.Unstructured, patches []Patch) (*unstructure
 	return objCopy, nil
 }
 
-func applyJSONPatch(obj *unstructured.Unstructured, change string) (*unstructured.Unstructured, error) {
-	patch, err := jsonpatch.DecodePatch([]byte(change))
+// idempotentPatches returns true if applying the patches to a resource that
+// they have already been applied to leaves the resource unchanged.
+//
+// Merge, strategic merge and apply patches set fields to the values in the
+// patch. JSON patches are idempotent if they only test and replace values, or
+// add fields to objects, and do not test the values that they change, because
+// the test fails once the value has been changed. Inserting into lists,
+// removing, moving and copying values are not, nor are templates, CEL and
+// Starlark patches which compute the changes from the resource.
+func idempotentPatches(patches []Patch) bool {
+	var tested, written []string
+	for _, patch := range patches {
+		if patch.Template {
+			return false
+		}
+
+		switch patch.Type {
+		case mergePatchType, strategicMergePatchType, applyPatchType:
+		case jsonPatchType:
+			operations, err := decodeJSONPatch(patch)
+			if err != nil {
+				return false
+			}
+			for _, operation := range operations {
+				if !idempotentOperation(operation) {
+					return false
+				}
+				path, err := operation.Path()
+				if err != nil {
+					return false
+				}
+				if operation.Kind() == "test" {
+					tested = append(tested, path)
+				} else {
+					written = append(written, path)
+				}
+			}
+		default:
+			return false
+		}
+	}
+
+	for _, t := range tested {
+		for _, w := range written {
+			if overlappingPaths(t, w) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+func idempotentOperation(operation jsonpatch.Operation) bool {
+	switch operation.Kind() {
+	case "test", "replace":
+		return true
+	case "add":
+		path, err := operation.Path()
+		if err != nil {
+			return false
+		}
+		// Adding to the end of a list or at an index inserts a new element.
+		last := path[strings.LastIndex(path, "/")+1:]
+		if _, err := strconv.Atoi(last); err == nil || last == "-" {
+			return false
+		}
+
+		return true
+	}
+
+	return false
+}
+
+// overlappingPaths returns true if the JSON pointers are the same, or one is
+// within the other.
+func overlappingPaths(a, b string) bool {
+	return a == b || strings.HasPrefix(a, b+"/") || strings.HasPrefix(b, a+"/")
+}
+
+func applyJSONPatch(obj *unstructured.Unstructured, p Patch) (*unstructured.Unstructured, error) {
+	patch, err := decodeJSONPatch(p)
 	if err != nil {
 		return nil, fmt.Errorf("decoding patch: %w", err)
 	}
@@ -49,12 +197,160 @@ func applyJSONPatch(obj *unstructured.Unstructured, change string) (*unstructure
 	})
 }
 
-func applyMergePatch(obj *unstructured.Unstructured, change string) (*unstructured.Unstructured, error) {
+// decodeJSONPatch returns the JSON Patch from the structured Operations if
+// they are provided, or by parsing the Change.
+func decodeJSONPatch(p Patch) (jsonpatch.Patch, error) {
+	if p.Operations == nil {
+		return jsonpatch.DecodePatch([]byte(p.Change))
+	}
+
+	patch := make(jsonpatch.Patch, len(p.Operations))
+	for i, op := range p.Operations {
+		operation := jsonpatch.Operation{
+			"op":   rawString(op.Op),
+			"path": rawString(op.Path),
+		}
+		if op.From != "" {
+			operation["from"] = rawString(op.From)
+		}
+		if op.Value != nil {
+			value := op.Value
+			operation["value"] = &value
+		}
+		patch[i] = operation
+	}
+
+	return patch, nil
+}
+
+func rawString(s string) *json.RawMessage {
+	// Marshalling a string cannot fail.
+	b, _ := json.Marshal(s)
+	raw := json.RawMessage(b)
+
+	return &raw
+}
+
+func applyMergePatch(obj *unstructured.Unstructured, p Patch) (*unstructured.Unstructured, error) {
+	change, err := mergeChange(p)
+	if err != nil {
+		return nil, err
+	}
+
+	return applyPatch(obj, func(b []byte) ([]byte, error) {
+		return jsonpatch.MergePatch(b, change)
+	})
+}
+
+func applyStrategicMergePatch(obj *unstructured.Unstructured, p Patch, o *applyOptions) (*unstructured.Unstructured, error) {
+	change, err := mergeChange(p)
+	if err != nil {
+		return nil, err
+	}
+
+	meta, err := lookupPatchMeta(obj.GroupVersionKind(), o)
+	if err != nil {
+		return nil, err
+	}
+
+	return applyPatch(obj, func(b []byte) ([]byte, error) {
+		return strategicpatch.StrategicMergePatchUsingLookupPatchMeta(b, change, meta)
+	})
+}
+
+// applyApplyPatch approximates a server-side apply of the change, using the
+// patch strategies for the resource if they are known, and a merge patch if
+// they are not.
+func applyApplyPatch(obj *unstructured.Unstructured, p Patch, o *applyOptions) (*unstructured.Unstructured, error) {
+	change, err := applyChange(p)
+	if err != nil {
+		return nil, err
+	}
+
+	meta, err := lookupPatchMeta(obj.GroupVersionKind(), o)
+	if err != nil {
+		return applyPatch(obj, func(b []byte) ([]byte, error) {
+			return jsonpatch.MergePatch(b, change)
+		})
+	}
+
 	return applyPatch(obj, func(b []byte) ([]byte, error) {
-		return jsonpatch.MergePatch(b, []byte(change))
+		return strategicpatch.StrategicMergePatchUsingLookupPatchMeta(b, change, meta)
 	})
 }
 
+// applyChange returns the change for an apply patch as JSON, the Change can
+// be YAML.
+func applyChange(p Patch) ([]byte, error) {
+	if p.Merge != nil {
+		return mergeChange(p)
+	}
+
+	change, err := yaml.YAMLToJSON([]byte(p.Change))
+	if err != nil {
+		return nil, fmt.Errorf("decoding apply patch: %w", err)
+	}
+
+	return change, nil
+}
+
+// mergeChange returns the change for a merge patch from the structured Merge
+// if it is provided, or from the Change.
+func mergeChange(p Patch) ([]byte, error) {
+	if p.Merge == nil {
+		return []byte(p.Change), nil
+	}
+
+	change, err := json.Marshal(p.Merge)
+	if err != nil {
+		return nil, fmt.Errorf("encoding merge patch: %w", err)
+	}
+
+	return change, nil
+}
+
+// lookupPatchMeta returns the strategic merge patch metadata for a GVK.
+//
+// The metadata comes from the Go types for built-in types, falling back to
+// the OpenAPI models if they are configured.
+func lookupPatchMeta(gvk schema.GroupVersionKind, o *applyOptions) (strategicpatch.LookupPatchMeta, error) {
+	if obj, err := clientgoscheme.Scheme.New(gvk); err == nil {
+		return strategicpatch.NewPatchMetaFromStruct(obj)
+	}
+
+	if o.openAPIModels != nil {
+		if s := lookupOpenAPISchema(o.openAPIModels, gvk); s != nil {
+			return strategicpatch.NewPatchMetaFromOpenAPI(s), nil
+		}
+	}
+
+	return nil, fmt.Errorf("no schema for strategic merge patch of %s", gvk)
+}
+
+// lookupOpenAPISchema finds the model with the GVK in its
+// x-kubernetes-group-version-kind extension.
+func lookupOpenAPISchema(models proto.Models, gvk schema.GroupVersionKind) proto.Schema {
+	for _, name := range models.ListModels() {
+		model := models.LookupModel(name)
+		gvks, ok := model.GetExtensions()["x-kubernetes-group-version-kind"].([]any)
+		if !ok {
+			continue
+		}
+
+		for _, v := range gvks {
+			ext, ok := v.(map[any]any)
+			if !ok {
+				continue
+			}
+			if ext["group"] == gvk.Group && ext["version"] == gvk.Version && ext["kind"] == gvk.Kind {
+				return model
+			}
+		}
+	}
+
+	return nil
+}
+
 type patchApplier func([]byte) ([]byte, error)
 
 func applyPatch(obj *unstructured.Unstructured, f patchApplier) (*unstructured.Unstructured, error) {
@@ -65,7 +361,6 @@ func applyPatch(obj *unstructured.Unstructured, f patchApplier) (*unstructured.U
 
 	patched, err := f(b)
 	if err != nil {
-		// TODO
 		return nil, err
 	}
 
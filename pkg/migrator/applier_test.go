@@ -1,15 +1,20 @@
 package migrator
 
 import (
+	"encoding/json"
+	"os"
 	"testing"
 
+	openapi_v2 "github.com/google/gnostic-models/openapiv2"
 	"github.com/google/go-cmp/cmp"
 	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/kube-openapi/pkg/util/proto"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/client/fake"
 )
@@ -196,3 +201,332 @@ func toUnstructured(t *testing.T, obj runtime.Object) *unstructured.Unstructured
 
 	return &unstructured.Unstructured{Object: raw}
 }
+
+func TestApplyPatches_structured_patches(t *testing.T) {
+	cm := newConfigMap()
+
+	patches := []Patch{
+		{
+			Type: "application/json-patch+json",
+			Operations: []Operation{
+				{Op: "replace", Path: "/data/testing", Value: json.RawMessage(`"new-value"`)},
+				{Op: "copy", From: "/data/testing", Path: "/data/copied"},
+			},
+		},
+		{
+			Type: "application/merge-patch+json",
+			Merge: map[string]any{
+				"metadata": map[string]any{
+					"labels": map[string]any{"migrated": "true"},
+				},
+			},
+		},
+	}
+
+	updated, err := ApplyPatches(toUnstructured(t, cm), patches)
+	assert.NoError(t, err)
+
+	want := &unstructured.Unstructured{
+		Object: map[string]any{
+			"apiVersion": "v1",
+			"data": map[string]any{
+				"copied":  "new-value",
+				"testing": "new-value",
+			},
+			"kind": "ConfigMap",
+			"metadata": map[string]any{
+				"creationTimestamp": nil,
+				"labels":            map[string]any{"migrated": "true"},
+				"name":              "test-cm",
+				"namespace":         "default",
+			},
+		},
+	}
+	if diff := cmp.Diff(want, updated); diff != "" {
+		t.Fatalf("failed to apply migrations:\n%s", diff)
+	}
+}
+
+func TestApplyPatches_strategic_merge_patch(t *testing.T) {
+	patchTests := []struct {
+		name   string
+		change string
+		want   []corev1.Container
+	}{
+		{
+			name:   "merging containers by name",
+			change: `{"spec":{"template":{"spec":{"containers":[{"name":"sidecar","image":"sidecar:v2"}]}}}}`,
+			want: []corev1.Container{
+				{
+					Name:  "app",
+					Image: "app:v1",
+					Env:   []corev1.EnvVar{{Name: "LOG_LEVEL", Value: "info"}, {Name: "PORT", Value: "8080"}},
+				},
+				{Name: "sidecar", Image: "sidecar:v2"},
+			},
+		},
+		{
+			name:   "merging env vars by name",
+			change: `{"spec":{"template":{"spec":{"containers":[{"name":"app","env":[{"name":"LOG_LEVEL","value":"debug"},{"name":"TRACING","value":"true"}]}]}}}}`,
+			want: []corev1.Container{
+				{
+					Name:  "app",
+					Image: "app:v1",
+					Env:   []corev1.EnvVar{{Name: "LOG_LEVEL", Value: "debug"}, {Name: "TRACING", Value: "true"}, {Name: "PORT", Value: "8080"}},
+				},
+				{Name: "sidecar", Image: "sidecar:v1"},
+			},
+		},
+		{
+			name:   "deleting an env var",
+			change: `{"spec":{"template":{"spec":{"containers":[{"name":"app","env":[{"name":"PORT","$patch":"delete"}]}]}}}}`,
+			want: []corev1.Container{
+				{
+					Name:  "app",
+					Image: "app:v1",
+					Env:   []corev1.EnvVar{{Name: "LOG_LEVEL", Value: "info"}},
+				},
+				{Name: "sidecar", Image: "sidecar:v1"},
+			},
+		},
+	}
+
+	for _, tt := range patchTests {
+		t.Run(tt.name, func(t *testing.T) {
+			patches := []Patch{
+				{
+					Type:   "application/strategic-merge-patch+json",
+					Change: tt.change,
+				},
+			}
+
+			updated, err := ApplyPatches(toUnstructured(t, newDeployment()), patches)
+			assert.NoError(t, err)
+
+			var deployment appsv1.Deployment
+			assert.NoError(t, runtime.DefaultUnstructuredConverter.FromUnstructured(updated.Object, &deployment))
+			if diff := cmp.Diff(tt.want, deployment.Spec.Template.Spec.Containers); diff != "" {
+				t.Fatalf("failed to apply migrations:\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestApplyPatches_strategic_merge_patch_with_openapi_models(t *testing.T) {
+	b, err := os.ReadFile("testdata/openapi/widgets.yaml")
+	assert.NoError(t, err)
+	doc, err := openapi_v2.ParseDocument(b)
+	assert.NoError(t, err)
+	models, err := proto.NewOpenAPIData(doc)
+	assert.NoError(t, err)
+
+	widget := newWidget()
+	patches := []Patch{
+		{
+			Type: "application/strategic-merge-patch+json",
+			Merge: map[string]any{
+				"spec": map[string]any{
+					"parts": []any{map[string]any{"name": "wheel", "size": 5}},
+				},
+			},
+		},
+	}
+
+	updated, err := ApplyPatches(widget, patches, WithOpenAPIModels(models))
+	assert.NoError(t, err)
+
+	want := []any{
+		map[string]any{"name": "wheel", "size": int64(5)},
+		map[string]any{"name": "axle", "size": int64(2)},
+	}
+	if diff := cmp.Diff(want, updated.Object["spec"].(map[string]any)["parts"]); diff != "" {
+		t.Fatalf("failed to apply migrations:\n%s", diff)
+	}
+}
+
+func TestApplyPatches_strategic_merge_patch_without_schema(t *testing.T) {
+	patches := []Patch{
+		{
+			Type:   "application/strategic-merge-patch+json",
+			Change: `{"spec":{"parts":[{"name":"wheel","size":5}]}}`,
+		},
+	}
+
+	_, err := ApplyPatches(newWidget(), patches)
+	assert.ErrorContains(t, err, "no schema for strategic merge patch of example.com/v1, Kind=Widget")
+}
+
+func newWidget() *unstructured.Unstructured {
+	return &unstructured.Unstructured{
+		Object: map[string]any{
+			"apiVersion": "example.com/v1",
+			"kind":       "Widget",
+			"metadata": map[string]any{
+				"name":      "test-widget",
+				"namespace": "default",
+			},
+			"spec": map[string]any{
+				"parts": []any{
+					map[string]any{"name": "wheel", "size": int64(4)},
+					map[string]any{"name": "axle", "size": int64(2)},
+				},
+			},
+		},
+	}
+}
+
+func newDeployment(opts ...func(*appsv1.Deployment)) *appsv1.Deployment {
+	deployment := &appsv1.Deployment{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "apps/v1",
+			Kind:       "Deployment",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-deployment",
+			Namespace: "default",
+		},
+		Spec: appsv1.DeploymentSpec{
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{
+							Name:  "app",
+							Image: "app:v1",
+							Env: []corev1.EnvVar{
+								{Name: "LOG_LEVEL", Value: "info"},
+								{Name: "PORT", Value: "8080"},
+							},
+						},
+						{Name: "sidecar", Image: "sidecar:v1"},
+					},
+				},
+			},
+		},
+	}
+
+	for _, o := range opts {
+		o(deployment)
+	}
+
+	return deployment
+}
+
+func TestApplyPatches_apply_patch(t *testing.T) {
+	patchTests := []struct {
+		name  string
+		obj   *unstructured.Unstructured
+		patch Patch
+		path  []string
+		want  any
+	}{
+		{
+			name: "built-in type merged by patch strategy",
+			obj:  toUnstructured(t, newDeployment()),
+			patch: Patch{
+				Type:   "application/apply-patch+yaml",
+				Change: "spec:\n  template:\n    spec:\n      containers:\n      - name: sidecar\n        image: sidecar:v2\n",
+			},
+			path: []string{"spec", "template", "spec", "containers"},
+			want: []any{
+				map[string]any{
+					"name":      "app",
+					"image":     "app:v1",
+					"resources": map[string]any{},
+					"env": []any{
+						map[string]any{"name": "LOG_LEVEL", "value": "info"},
+						map[string]any{"name": "PORT", "value": "8080"},
+					},
+				},
+				map[string]any{"name": "sidecar", "image": "sidecar:v2", "resources": map[string]any{}},
+			},
+		},
+		{
+			name: "custom resource without schema merged as a merge patch",
+			obj:  newWidget(),
+			patch: Patch{
+				Type:  "application/apply-patch+yaml",
+				Merge: map[string]any{"spec": map[string]any{"parts": []any{map[string]any{"name": "wheel", "size": 5}}}},
+			},
+			path: []string{"spec", "parts"},
+			want: []any{map[string]any{"name": "wheel", "size": int64(5)}},
+		},
+	}
+
+	for _, tt := range patchTests {
+		t.Run(tt.name, func(t *testing.T) {
+			updated, err := ApplyPatches(tt.obj, []Patch{tt.patch})
+			assert.NoError(t, err)
+
+			got, _, err := unstructured.NestedFieldNoCopy(updated.Object, tt.path...)
+			assert.NoError(t, err)
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Fatalf("failed to apply migrations:\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestIdempotentPatches(t *testing.T) {
+	idempotentTests := []struct {
+		name    string
+		patches []Patch
+		want    bool
+	}{
+		{
+			name:    "merge patch",
+			patches: []Patch{{Type: "application/merge-patch+json", Change: `{"data":{"testing":"new-value"}}`}},
+			want:    true,
+		},
+		{
+			name:    "replace and add fields",
+			patches: []Patch{{Type: "application/json-patch+json", Change: `[{"op":"replace","path":"/data/testing","value":"new-value"},{"op":"add","path":"/data/new","value":"value"}]`}},
+			want:    true,
+		},
+		{
+			name:    "test other fields",
+			patches: []Patch{{Type: "application/json-patch+json", Change: `[{"op":"test","path":"/metadata/labels/app","value":"test"},{"op":"replace","path":"/data/testing","value":"new-value"}]`}},
+			want:    true,
+		},
+		{
+			name:    "test the replaced field",
+			patches: []Patch{{Type: "application/json-patch+json", Change: `[{"op":"test","path":"/spec/type","value":"ClusterIP"},{"op":"replace","path":"/spec/type","value":"NodePort"}]`}},
+		},
+		{
+			name:    "test a field within the replaced field",
+			patches: []Patch{{Type: "application/json-patch+json", Change: `[{"op":"test","path":"/spec/ports/0/port","value":80},{"op":"replace","path":"/spec/ports/0","value":{"port":81}}]`}},
+		},
+		{
+			name: "test a field replaced by a later patch",
+			patches: []Patch{
+				{Type: "application/json-patch+json", Change: `[{"op":"test","path":"/data/testing","value":"old-value"}]`},
+				{Type: "application/json-patch+json", Change: `[{"op":"replace","path":"/data/testing","value":"new-value"}]`},
+			},
+		},
+		{
+			name:    "add to the end of a list",
+			patches: []Patch{{Type: "application/json-patch+json", Change: `[{"op":"add","path":"/spec/ports/-","value":{"port":8080}}]`}},
+		},
+		{
+			name:    "insert into a list",
+			patches: []Patch{{Type: "application/json-patch+json", Operations: []Operation{{Op: "add", Path: "/spec/ports/0", Value: json.RawMessage(`{"port":8080}`)}}}},
+		},
+		{
+			name:    "remove",
+			patches: []Patch{{Type: "application/json-patch+json", Change: `[{"op":"remove","path":"/data/testing"}]`}},
+		},
+		{
+			name:    "template",
+			patches: []Patch{{Type: "application/merge-patch+json", Template: true, Change: `{"data":{"name":"{{ .Name }}"}}`}},
+		},
+		{
+			name:    "CEL",
+			patches: []Patch{{Type: "application/cel", Change: `{"/spec/replicas": object.spec.replicas * 2}`}},
+		},
+	}
+
+	for _, tt := range idempotentTests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, idempotentPatches(tt.patches))
+		})
+	}
+}
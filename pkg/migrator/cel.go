@@ -0,0 +1,185 @@
+package migrator
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	jsonpatch "github.com/evanphx/json-patch/v5"
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/ext"
+	"google.golang.org/protobuf/types/known/structpb"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// celCostLimit limits the cost of evaluating an expression, so that an
+// expression cannot loop over a large resource indefinitely.
+const celCostLimit = 1000000
+
+var celEnv = sync.OnceValues(func() (*cel.Env, error) {
+	return cel.NewEnv(
+		cel.Variable("object", cel.DynType),
+		cel.Variable("vars", cel.MapType(cel.StringType, cel.StringType)),
+		ext.Strings(),
+	)
+})
+
+// compileCEL compiles the expression of a CEL patch.
+func compileCEL(expression string) (cel.Program, error) {
+	env, err := celEnv()
+	if err != nil {
+		return nil, fmt.Errorf("creating CEL environment: %w", err)
+	}
+
+	ast, issues := env.Compile(expression)
+	if issues != nil && issues.Err() != nil {
+		return nil, fmt.Errorf("compiling CEL expression: %w", issues.Err())
+	}
+
+	prg, err := env.Program(ast, cel.CostLimit(celCostLimit))
+	if err != nil {
+		return nil, fmt.Errorf("compiling CEL expression: %w", err)
+	}
+
+	return prg, nil
+}
+
+// applyCELPatch evaluates the CEL expression in the change with the resource
+// as object.
+//
+// If the expression returns a map where all the keys are JSON pointers e.g.
+// {"/spec/replicas": object.spec.replicas * 2}, the values are set at the
+// pointers, and a null value removes the field. Otherwise the map that is
+// returned replaces the resource.
+func applyCELPatch(obj *unstructured.Unstructured, p Patch, o *applyOptions) (*unstructured.Unstructured, error) {
+	prg, err := compileCEL(p.Change)
+	if err != nil {
+		return nil, err
+	}
+
+	vars := o.vars
+	if vars == nil {
+		vars = map[string]string{}
+	}
+	val, _, err := prg.Eval(map[string]any{"object": obj.Object, "vars": vars})
+	if err != nil {
+		return nil, fmt.Errorf("evaluating CEL expression for %s %s: %w", obj.GetKind(), obj.GetName(), err)
+	}
+
+	native, err := val.ConvertToNative(reflect.TypeOf(&structpb.Value{}))
+	if err != nil {
+		return nil, fmt.Errorf("converting result of CEL expression: %w", err)
+	}
+	result, ok := native.(*structpb.Value).AsInterface().(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("CEL expression must return a map, got %s", val.Type().TypeName())
+	}
+
+	if !isMutationSet(result) {
+		// The result is decoded from JSON so that numbers are integers where
+		// possible.
+		return applyPatch(obj, func([]byte) ([]byte, error) {
+			return json.Marshal(result)
+		})
+	}
+
+	patch, err := mutationPatch(obj, result)
+	if err != nil {
+		return nil, err
+	}
+
+	options := jsonpatch.NewApplyOptions()
+	options.EnsurePathExistsOnAdd = true
+
+	return applyPatch(obj, func(b []byte) ([]byte, error) {
+		return patch.ApplyWithOptions(b, options)
+	})
+}
+
+func isMutationSet(result map[string]any) bool {
+	if len(result) == 0 {
+		return false
+	}
+
+	for k := range result {
+		if !strings.HasPrefix(k, "/") {
+			return false
+		}
+	}
+
+	return true
+}
+
+// mutationPatch returns a JSON Patch that sets the values of a mutation set,
+// replacing fields that exist, adding the fields that do not, and removing
+// the fields with null values.
+func mutationPatch(obj *unstructured.Unstructured, mutations map[string]any) (jsonpatch.Patch, error) {
+	pointers := make([]string, 0, len(mutations))
+	for k := range mutations {
+		pointers = append(pointers, k)
+	}
+	slices.Sort(pointers)
+
+	var patch jsonpatch.Patch
+	for _, pointer := range pointers {
+		exists := pointerExists(obj.Object, pointer)
+		value := mutations[pointer]
+
+		op := "add"
+		switch {
+		case value == nil && !exists:
+			continue
+		case value == nil:
+			op = "remove"
+		case exists:
+			op = "replace"
+		}
+
+		operation := jsonpatch.Operation{
+			"op":   rawString(op),
+			"path": rawString(pointer),
+		}
+		if value != nil {
+			b, err := json.Marshal(value)
+			if err != nil {
+				return nil, fmt.Errorf("encoding value for %s: %w", pointer, err)
+			}
+			raw := json.RawMessage(b)
+			operation["value"] = &raw
+		}
+		patch = append(patch, operation)
+	}
+
+	return patch, nil
+}
+
+// pointerExists returns true if the value identified by a JSON pointer exists
+// in the resource.
+func pointerExists(obj any, pointer string) bool {
+	unescape := strings.NewReplacer("~1", "/", "~0", "~")
+	for _, token := range strings.Split(pointer, "/")[1:] {
+		token = unescape.Replace(token)
+		switch v := obj.(type) {
+		case map[string]any:
+			value, ok := v[token]
+			if !ok {
+				return false
+			}
+			obj = value
+		case []any:
+			i, err := strconv.Atoi(token)
+			if err != nil || i < 0 || i >= len(v) {
+				return false
+			}
+			obj = v[i]
+		default:
+			return false
+		}
+	}
+
+	return true
+}
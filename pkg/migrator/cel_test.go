@@ -0,0 +1,137 @@
+package migrator
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestApplyPatches_cel(t *testing.T) {
+	celTests := []struct {
+		name       string
+		expression string
+		opts       []ApplyOption
+		deployment *appsv1.Deployment
+		want       *appsv1.Deployment
+	}{
+		{
+			name:       "multiply replicas",
+			expression: `{"/spec/replicas": object.spec.replicas * 2}`,
+			deployment: newDeployment(withReplicas(3)),
+			want:       newDeployment(withReplicas(6)),
+		},
+		{
+			name: "rename environment variables",
+			expression: `{"/spec/template/spec/containers/0/env": object.spec.template.spec.containers[0].env.map(e,
+				e.name.startsWith("LOG_") ? {"name": "APP_" + e.name, "value": e.value} : e)}`,
+			deployment: newDeployment(),
+			want: newDeployment(func(d *appsv1.Deployment) {
+				d.Spec.Template.Spec.Containers[0].Env = []corev1.EnvVar{
+					{Name: "APP_LOG_LEVEL", Value: "info"},
+					{Name: "PORT", Value: "8080"},
+				}
+			}),
+		},
+		{
+			name:       "add a missing field",
+			expression: `{"/spec/template/metadata/labels/app": object.metadata.name}`,
+			deployment: newDeployment(),
+			want: newDeployment(func(d *appsv1.Deployment) {
+				d.Spec.Template.Labels = map[string]string{"app": "test-deployment"}
+			}),
+		},
+		{
+			name:       "remove a field",
+			expression: `{"/spec/replicas": null}`,
+			deployment: newDeployment(withReplicas(3)),
+			want:       newDeployment(),
+		},
+		{
+			name:       "variables",
+			expression: `{"/spec/template/spec/containers/1/image": "sidecar:" + vars.version}`,
+			opts:       []ApplyOption{WithVariables(map[string]string{"version": "v2"})},
+			deployment: newDeployment(),
+			want: newDeployment(func(d *appsv1.Deployment) {
+				d.Spec.Template.Spec.Containers[1].Image = "sidecar:v2"
+			}),
+		},
+	}
+
+	for _, tt := range celTests {
+		t.Run(tt.name, func(t *testing.T) {
+			patch := Patch{Type: "application/cel", Change: tt.expression}
+
+			updated, err := ApplyPatches(toUnstructured(t, tt.deployment), []Patch{patch}, tt.opts...)
+			assert.NoError(t, err)
+
+			var got appsv1.Deployment
+			assert.NoError(t, runtime.DefaultUnstructuredConverter.FromUnstructured(updated.Object, &got))
+			if diff := cmp.Diff(tt.want, &got); diff != "" {
+				t.Fatalf("failed to apply CEL patch:\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestApplyPatches_cel_object(t *testing.T) {
+	cm := toUnstructured(t, newConfigMap())
+	patch := Patch{
+		Type: "application/cel",
+		Change: `{"apiVersion": object.apiVersion, "kind": object.kind, "metadata": object.metadata,
+			"data": {"TESTING": object.data.testing.upperAscii()}}`,
+	}
+
+	updated, err := ApplyPatches(cm, []Patch{patch})
+	assert.NoError(t, err)
+
+	var got corev1.ConfigMap
+	assert.NoError(t, runtime.DefaultUnstructuredConverter.FromUnstructured(updated.Object, &got))
+	if diff := cmp.Diff(newConfigMap(func(cm *corev1.ConfigMap) {
+		cm.Data = map[string]string{"TESTING": "TEST"}
+	}), &got); diff != "" {
+		t.Fatalf("failed to apply CEL patch:\n%s", diff)
+	}
+}
+
+func TestApplyPatches_cel_errors(t *testing.T) {
+	celTests := []struct {
+		name       string
+		expression string
+		wantErr    string
+	}{
+		{
+			name:       "invalid expression",
+			expression: `{"/spec/replicas": object.spec.replicas *}`,
+			wantErr:    "compiling CEL expression",
+		},
+		{
+			name:       "missing field",
+			expression: `{"/spec/replicas": object.spec.paused}`,
+			wantErr:    "evaluating CEL expression for Deployment test-deployment: no such key: paused",
+		},
+		{
+			name:       "not a map",
+			expression: `object.spec.replicas * 2`,
+			wantErr:    "CEL expression must return a map, got int",
+		},
+	}
+
+	for _, tt := range celTests {
+		t.Run(tt.name, func(t *testing.T) {
+			patch := Patch{Type: "application/cel", Change: tt.expression}
+
+			_, err := ApplyPatches(toUnstructured(t, newDeployment(withReplicas(3))), []Patch{patch})
+			assert.ErrorContains(t, err, tt.wantErr)
+		})
+	}
+}
+
+func withReplicas(n int32) func(*appsv1.Deployment) {
+	return func(d *appsv1.Deployment) {
+		d.Spec.Replicas = ptr(n)
+	}
+}
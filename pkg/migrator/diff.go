@@ -0,0 +1,218 @@
+package migrator
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/bigkevmcd/migrator/pkg/api/v1alpha1"
+	"github.com/pmezard/go-difflib/difflib"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	colorReset = "\x1b[0m"
+	colorBold  = "\x1b[1m"
+	colorRed   = "\x1b[31m"
+	colorGreen = "\x1b[32m"
+	colorCyan  = "\x1b[36m"
+)
+
+// WithColor configures diffs to be written with terminal colours.
+func WithColor() Option {
+	return func(o *options) {
+		o.color = true
+	}
+}
+
+// Diff writes a unified diff of the changes that the Up patches of the
+// migrations would make to the resources in the cluster.
+//
+// When a StateStore is configured, the migrations that have been applied are
+// skipped. Each migration is applied to the resources as patched by the
+// earlier migrations, and there is one diff for each resource.
+//
+// The managed fields and status of the resources are not included in the
+// diff.
+func Diff(ctx context.Context, kubeClient client.Reader, migrations []Migration, w io.Writer, opts ...Option) error {
+	o := newOptions(opts)
+	applied, err := appliedMigrations(ctx, o.stateStore)
+	if err != nil {
+		return err
+	}
+
+	var (
+		originals []unstructured.Unstructured
+		patched   = map[resourceKey]*unstructured.Unstructured{}
+	)
+	for _, migration := range migrations {
+		if record, ok := applied[migration.Name]; ok {
+			checksum, err := migration.Checksum()
+			if err != nil {
+				return err
+			}
+			if record.Checksum != checksum {
+				return fmt.Errorf("migration %s has changed since it was applied", migration.Name)
+			}
+			continue
+		}
+
+		toMigrate, err := resourcesToMigrate(ctx, kubeClient, migration, int64(o.batchSize))
+		if err != nil {
+			return err
+		}
+		for i := range toMigrate {
+			if u, ok := patched[keyOf(&toMigrate[i])]; ok {
+				toMigrate[i] = *u
+			}
+		}
+
+		toMigrate, err = filterPreconditions(migration, toMigrate, func(*unstructured.Unstructured, string) error {
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, resource := range toMigrate {
+			updated, err := ApplyPatches(&resource, migration.Up, o.applyOpts...)
+			if err != nil {
+				return err
+			}
+
+			key := keyOf(&resource)
+			if _, ok := patched[key]; !ok {
+				originals = append(originals, resource)
+			}
+			patched[key] = updated
+		}
+	}
+
+	for _, original := range originals {
+		before, err := diffableYAML(&original)
+		if err != nil {
+			return err
+		}
+		after, err := diffableYAML(patched[keyOf(&original)])
+		if err != nil {
+			return err
+		}
+
+		name := fmt.Sprintf("%s %s", original.GetKind(), client.ObjectKeyFromObject(&original))
+		if err := writeDiff(w, name, before, after, o.color); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// resourceKey identifies a resource across migrations.
+type resourceKey struct {
+	schema.GroupVersionKind
+	client.ObjectKey
+}
+
+func keyOf(u *unstructured.Unstructured) resourceKey {
+	return resourceKey{GroupVersionKind: u.GroupVersionKind(), ObjectKey: client.ObjectKeyFromObject(u)}
+}
+
+// DiffDirectory writes a unified diff of the changes that the Up patches of
+// the migrations would make to the YAML files in a directory.
+func DiffDirectory(dir string, migrations []Migration, w io.Writer, opts ...Option) error {
+	o := newOptions(opts)
+	manifests, err := migrateManifests(dir, migrations, o, v1alpha1.DirectionUp)
+	if err != nil {
+		return err
+	}
+
+	for _, manifest := range manifests {
+		if !manifest.changed {
+			continue
+		}
+
+		after, err := manifest.encode()
+		if err != nil {
+			return err
+		}
+
+		if err := writeDiff(w, manifest.filename, string(manifest.original), string(after), o.color); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func diffableYAML(u *unstructured.Unstructured) (string, error) {
+	u = u.DeepCopy()
+	u.SetManagedFields(nil)
+	unstructured.RemoveNestedField(u.Object, "status")
+
+	b, err := yaml.Marshal(u.Object)
+	if err != nil {
+		return "", fmt.Errorf("marshalling %s %s to YAML: %w", u.GetKind(), client.ObjectKeyFromObject(u), err)
+	}
+
+	return string(b), nil
+}
+
+func writeDiff(w io.Writer, name, before, after string, color bool) error {
+	if before == after {
+		return nil
+	}
+
+	diff, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        splitLines(before),
+		B:        splitLines(after),
+		FromFile: name,
+		ToFile:   name,
+		Context:  3,
+	})
+	if err != nil {
+		return fmt.Errorf("calculating diff for %s: %w", name, err)
+	}
+
+	if !color {
+		_, err := io.WriteString(w, diff)
+		return err
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(diff))
+	for scanner.Scan() {
+		if _, err := fmt.Fprintln(w, colorize(scanner.Text())); err != nil {
+			return err
+		}
+	}
+
+	return scanner.Err()
+}
+
+func splitLines(s string) []string {
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	return lines
+}
+
+func colorize(line string) string {
+	switch {
+	case strings.HasPrefix(line, "---"), strings.HasPrefix(line, "+++"):
+		return colorBold + line + colorReset
+	case strings.HasPrefix(line, "@@"):
+		return colorCyan + line + colorReset
+	case strings.HasPrefix(line, "-"):
+		return colorRed + line + colorReset
+	case strings.HasPrefix(line, "+"):
+		return colorGreen + line + colorReset
+	}
+
+	return line
+}
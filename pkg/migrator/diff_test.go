@@ -0,0 +1,183 @@
+package migrator
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/stretchr/testify/assert"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/kustomize/v3/pkg/gvk"
+	"sigs.k8s.io/kustomize/v3/pkg/types"
+)
+
+var diffTestMigrations = []Migration{
+	{
+		Name: "patch-service",
+		Target: Target{
+			PatchTarget: types.PatchTarget{
+				Gvk: gvk.Gvk{
+					Group:   "",
+					Version: "v1",
+					Kind:    "Service",
+				},
+				Namespace: "default",
+				Name:      "test-svc",
+			},
+		},
+		Up: []Patch{
+			{
+				Type:   "application/json-patch+json",
+				Change: `[{"op":"replace","path":"/spec/ports/0/targetPort","value":9371}]`,
+			},
+		},
+	},
+}
+
+func TestDiff(t *testing.T) {
+	fc := fake.NewClientBuilder().WithObjects(newService()).Build()
+	var out bytes.Buffer
+
+	if err := Diff(context.TODO(), fc, diffTestMigrations, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `--- Service default/test-svc
++++ Service default/test-svc
+@@ -10,4 +10,4 @@
+   - name: http-80
+     port: 80
+     protocol: TCP
+-    targetPort: 9376
++    targetPort: 9371
+`
+	if diff := cmp.Diff(want, out.String()); diff != "" {
+		t.Fatalf("failed to diff:\n%s", diff)
+	}
+}
+
+func TestDiff_with_color(t *testing.T) {
+	fc := fake.NewClientBuilder().WithObjects(newService()).Build()
+	var out bytes.Buffer
+
+	if err := Diff(context.TODO(), fc, diffTestMigrations, &out, WithColor()); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Contains(t, out.String(), "\x1b[31m-    targetPort: 9376\x1b[0m\n")
+	assert.Contains(t, out.String(), "\x1b[32m+    targetPort: 9371\x1b[0m\n")
+}
+
+func TestDiff_chained_migrations(t *testing.T) {
+	migrations := append(slices.Clone(diffTestMigrations), Migration{
+		Name: "label-service",
+		Target: Target{
+			PatchTarget: types.PatchTarget{
+				Gvk:       gvk.Gvk{Version: "v1", Kind: "Service"},
+				Namespace: "default",
+				Name:      "test-svc",
+			},
+		},
+		Up: []Patch{
+			{
+				// The test fails if the port was not changed by the earlier
+				// migration.
+				Type:   "application/json-patch+json",
+				Change: `[{"op":"test","path":"/spec/ports/0/targetPort","value":9371},{"op":"add","path":"/metadata/labels","value":{"migrated":"true"}}]`,
+			},
+		},
+	})
+	fc := fake.NewClientBuilder().WithObjects(newService()).Build()
+	var out bytes.Buffer
+
+	if err := Diff(context.TODO(), fc, migrations, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `--- Service default/test-svc
++++ Service default/test-svc
+@@ -2,6 +2,8 @@
+ kind: Service
+ metadata:
+   creationTimestamp: null
++  labels:
++    migrated: "true"
+   name: test-svc
+   namespace: default
+   resourceVersion: "999"
+@@ -10,4 +12,4 @@
+   - name: http-80
+     port: 80
+     protocol: TCP
+-    targetPort: 9376
++    targetPort: 9371
+`
+	if diff := cmp.Diff(want, out.String()); diff != "" {
+		t.Fatalf("failed to diff:\n%s", diff)
+	}
+}
+
+func TestDiff_with_state_store(t *testing.T) {
+	migrations := []Migration{
+		{
+			Name: "add-port",
+			Target: Target{
+				PatchTarget: types.PatchTarget{
+					Gvk:       gvk.Gvk{Version: "v1", Kind: "Service"},
+					Namespace: "default",
+					Name:      "test-svc",
+				},
+			},
+			Up: []Patch{
+				{
+					Type:   "application/json-patch+json",
+					Change: `[{"op":"test","path":"/spec/ports/0/targetPort","value":9376},{"op":"add","path":"/spec/ports/-","value":{"name":"https","port":443}}]`,
+				},
+			},
+		},
+	}
+	fc := fake.NewClientBuilder().WithObjects(newService()).Build()
+	store := NewConfigMapStateStore(fc, client.ObjectKey{Name: "migrator-state", Namespace: "default"})
+	if err := MigrateUp(context.TODO(), fc, migrations, WithStateStore(store)); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+
+	// The applied migration is not applied again.
+	if err := Diff(context.TODO(), fc, migrations, &out, WithStateStore(store)); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Empty(t, out.String())
+}
+
+func TestDiffDirectory(t *testing.T) {
+	var out bytes.Buffer
+
+	if err := DiffDirectory("testdata/manifests", diffTestMigrations, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	filename := filepath.Join("testdata/manifests", "services.yaml")
+	want := `--- ` + filename + `
++++ ` + filename + `
+@@ -11,7 +11,7 @@
+     - name: http-80
+       protocol: TCP
+       port: 80 # the public port
+-      targetPort: 9376
++      targetPort: 9371
+ ---
+ apiVersion: v1
+ kind: Service
+`
+	if diff := cmp.Diff(want, out.String()); diff != "" {
+		t.Fatalf("failed to diff:\n%s", diff)
+	}
+	// The files are not modified.
+	assert.Contains(t, readFile(t, filename), "targetPort: 9376")
+}
@@ -0,0 +1,62 @@
+package migrator
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// ResourceError is returned when a resource cannot be migrated.
+type ResourceError struct {
+	Migration        string
+	GroupVersionKind schema.GroupVersionKind
+	Key              client.ObjectKey
+	Err              error
+}
+
+func (e *ResourceError) Error() string {
+	return fmt.Sprintf("migration %s: %s %s: %s", e.Migration, e.GroupVersionKind.Kind, e.Key, e.Err)
+}
+
+func (e *ResourceError) Unwrap() error {
+	return e.Err
+}
+
+// MigrationErrors is returned when migrating with WithKeepGoing and one or more
+// resources could not be migrated.
+type MigrationErrors []*ResourceError
+
+func (e MigrationErrors) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d resources failed to migrate:", len(e))
+	for _, err := range e {
+		fmt.Fprintf(&b, "\n  %s", err)
+	}
+
+	return b.String()
+}
+
+func (e MigrationErrors) Unwrap() []error {
+	errs := make([]error, len(e))
+	for i, err := range e {
+		errs[i] = err
+	}
+
+	return errs
+}
+
+// failures collects the ResourceErrors from concurrent migrations.
+type failures struct {
+	mu   sync.Mutex
+	errs MigrationErrors
+}
+
+func (f *failures) add(err *ResourceError) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.errs = append(f.errs, err)
+}
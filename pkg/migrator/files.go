@@ -0,0 +1,372 @@
+package migrator
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/bigkevmcd/migrator/pkg/api/v1alpha1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/kustomize/kyaml/comments"
+	"sigs.k8s.io/kustomize/kyaml/kio"
+	"sigs.k8s.io/kustomize/kyaml/kio/kioutil"
+	"sigs.k8s.io/kustomize/kyaml/order"
+	kyaml "sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+// readerAnnotations are added to resources by the kio.ByteReader and are
+// removed before the resources are patched.
+var readerAnnotations = []string{
+	kioutil.IndexAnnotation,
+	kioutil.LegacyIndexAnnotation,
+	kioutil.SeqIndentAnnotation,
+}
+
+// MigrateDirectoryUp executes the migrations forward against the resources in
+// the YAML files in a directory.
+//
+// Files are rewritten in place, comments and the order of keys are preserved.
+//
+// With a client dry-run, the patch for each resource is written to the output
+// configured with WithOutput and the files are not changed, server dry-runs
+// are not supported.
+func MigrateDirectoryUp(dir string, migrations []Migration, opts ...Option) error {
+	return migrateDirectory(dir, migrations, newOptions(opts), v1alpha1.DirectionUp)
+}
+
+// MigrateDirectoryDown executes the migrations down against the resources in
+// the YAML files in a directory, in the reverse order of the migrations.
+//
+// The migrations that are executed can be limited with WithDownTo and
+// WithDownSteps.
+func MigrateDirectoryDown(dir string, migrations []Migration, opts ...Option) error {
+	o := newOptions(opts)
+	toMigrate, err := migrationsToRollback(o, nil, migrations)
+	if err != nil {
+		return err
+	}
+
+	return migrateDirectory(dir, toMigrate, o, v1alpha1.DirectionDown)
+}
+
+func migrateDirectory(dir string, migrations []Migration, o *options, direction v1alpha1.Direction) error {
+	if o.dryRun == DryRunServer {
+		return errors.New("a server dry-run cannot be used to migrate files")
+	}
+
+	manifests, err := migrateManifests(dir, migrations, o, direction)
+	if err != nil {
+		return err
+	}
+
+	if !o.persist() {
+		return nil
+	}
+
+	for _, manifest := range manifests {
+		if err := manifest.write(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// migrateManifests reads the manifests in dir and migrates them without writing
+// the changes.
+func migrateManifests(dir string, migrations []Migration, o *options, direction v1alpha1.Direction) ([]*manifestFile, error) {
+	manifests, err := readManifests(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, migration := range migrations {
+		for _, manifest := range manifests {
+			if err := manifest.migrate(migration, direction, o); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return manifests, nil
+}
+
+// manifestFile is a file containing one or more Kubernetes resources.
+type manifestFile struct {
+	filename string
+	original []byte
+	nodes    []*kyaml.RNode
+	changed  bool
+}
+
+func readManifests(dir string) ([]*manifestFile, error) {
+	var manifests []*manifestFile
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() {
+			if path != dir && strings.HasPrefix(d.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if !isYAMLFile(d.Name()) {
+			return nil
+		}
+
+		manifest, err := readManifest(path)
+		if err != nil {
+			return err
+		}
+		if manifest != nil {
+			manifests = append(manifests, manifest)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("reading manifests in %s: %w", dir, err)
+	}
+
+	return manifests, nil
+}
+
+// readManifest parses the resources in a file, nil is returned for files
+// without resources, e.g. Helm values or migrations.
+func readManifest(filename string) (*manifestFile, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	ok, err := hasResources(b)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", filename, err)
+	}
+	if !ok {
+		return nil, nil
+	}
+
+	nodes, err := (&kio.ByteReader{
+		Reader:            bytes.NewReader(b),
+		PreserveSeqIndent: true,
+	}).Read()
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", filename, err)
+	}
+
+	return &manifestFile{filename: filename, original: b, nodes: nodes}, nil
+}
+
+// resources returns the resources in the file that match the migration
+// Target and, when migrating up, pass its preconditions.
+func (m *manifestFile) resources(migration Migration, direction v1alpha1.Direction) ([]int, []unstructured.Unstructured, error) {
+	selector, err := migration.Target.selector()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var (
+		indexes   []int
+		resources []unstructured.Unstructured
+	)
+	for i, node := range m.nodes {
+		if !isResource(node.YNode()) {
+			continue
+		}
+
+		u, err := nodeToUnstructured(node)
+		if err != nil {
+			return nil, nil, fmt.Errorf("parsing resource in %s: %w", m.filename, err)
+		}
+
+		if !matchesGroupVersionKind(u, migration) || !selector.matches(u) {
+			continue
+		}
+
+		// The preconditions hold for the resources before they are migrated
+		// up, and may not once they have been.
+		if direction == v1alpha1.DirectionUp {
+			reason, err := migration.When.check(u)
+			if err != nil {
+				return nil, nil, fmt.Errorf("checking preconditions of migration %s: %w", migration.Name, err)
+			}
+			if reason != "" {
+				continue
+			}
+		}
+
+		indexes = append(indexes, i)
+		resources = append(resources, *u)
+	}
+
+	return indexes, resources, nil
+}
+
+func (m *manifestFile) migrate(migration Migration, direction v1alpha1.Direction, o *options) error {
+	indexes, resources, err := m.resources(migration, direction)
+	if err != nil {
+		return err
+	}
+
+	patches := migration.Up
+	if direction == v1alpha1.DirectionDown {
+		patches = migration.Down
+	}
+
+	for i, resource := range resources {
+		updated, err := ApplyPatches(&resource, patches, o.applyOpts...)
+		if err != nil {
+			return fmt.Errorf("migrating %s %s in %s: %w", resource.GetKind(), resource.GetName(), m.filename, err)
+		}
+
+		// Replacing an unchanged resource would change its formatting, e.g.
+		// flow style maps and quoted strings.
+		if reflect.DeepEqual(resource.Object, updated.Object) {
+			continue
+		}
+
+		if o.dryRun != DryRunNone {
+			if err := reportPatch(o.out, updated, client.MergeFrom(&resource)); err != nil {
+				return err
+			}
+		}
+
+		if err := m.replace(indexes[i], updated); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// replace replaces the node at index with the updated resource, keeping the
+// comments and field order from the original node.
+func (m *manifestFile) replace(index int, updated *unstructured.Unstructured) error {
+	original := m.nodes[index]
+	node, err := kyaml.FromMap(updated.Object)
+	if err != nil {
+		return fmt.Errorf("converting %s %s in %s: %w", updated.GetKind(), updated.GetName(), m.filename, err)
+	}
+
+	for _, k := range readerAnnotations {
+		if v, ok := original.GetAnnotations()[k]; ok {
+			if err := node.PipeE(kyaml.SetAnnotation(k, v)); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := comments.CopyComments(original, node); err != nil {
+		return fmt.Errorf("copying comments in %s: %w", m.filename, err)
+	}
+	if err := order.SyncOrder(original, node); err != nil {
+		return fmt.Errorf("ordering fields in %s: %w", m.filename, err)
+	}
+
+	m.nodes[index] = node
+	m.changed = true
+
+	return nil
+}
+
+func (m *manifestFile) write() error {
+	if !m.changed {
+		return nil
+	}
+
+	b, err := m.encode()
+	if err != nil {
+		return err
+	}
+
+	info, err := os.Stat(m.filename)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(m.filename, b, info.Mode())
+}
+
+func (m *manifestFile) encode() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := (kio.ByteWriter{Writer: &buf}).Write(m.nodes); err != nil {
+		return nil, fmt.Errorf("encoding %s: %w", m.filename, err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// hasResources returns true if any of the documents in a file is a Kubernetes
+// resource.
+func hasResources(b []byte) (bool, error) {
+	decoder := kyaml.NewDecoder(bytes.NewReader(b))
+	for {
+		var doc kyaml.Node
+		if err := decoder.Decode(&doc); err != nil {
+			if errors.Is(err, io.EOF) {
+				return false, nil
+			}
+
+			return false, err
+		}
+
+		if len(doc.Content) > 0 && isResource(doc.Content[0]) {
+			return true, nil
+		}
+	}
+}
+
+// isResource returns true if the node is an object with an apiVersion and a
+// kind.
+func isResource(node *kyaml.Node) bool {
+	if node.Kind != kyaml.MappingNode {
+		return false
+	}
+
+	var apiVersion, kind bool
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		switch node.Content[i].Value {
+		case "apiVersion":
+			apiVersion = node.Content[i+1].Value != ""
+		case "kind":
+			kind = node.Content[i+1].Value != ""
+		}
+	}
+
+	return apiVersion && kind
+}
+
+func nodeToUnstructured(node *kyaml.RNode) (*unstructured.Unstructured, error) {
+	node = node.Copy()
+	for _, k := range readerAnnotations {
+		if err := node.PipeE(kyaml.ClearAnnotation(k)); err != nil {
+			return nil, err
+		}
+	}
+	if err := kyaml.ClearEmptyAnnotations(node); err != nil {
+		return nil, err
+	}
+
+	b, err := node.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+
+	u := &unstructured.Unstructured{}
+	if err := u.UnmarshalJSON(b); err != nil {
+		return nil, err
+	}
+
+	return u, nil
+}
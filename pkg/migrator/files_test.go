@@ -0,0 +1,356 @@
+package migrator
+
+import (
+	"bytes"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/stretchr/testify/assert"
+	"sigs.k8s.io/kustomize/v3/pkg/gvk"
+	"sigs.k8s.io/kustomize/v3/pkg/types"
+	"sigs.k8s.io/yaml"
+)
+
+func TestMigrateDirectoryUp(t *testing.T) {
+	dir := copyManifests(t, "testdata/manifests")
+	migrations := []Migration{
+		{
+			Name: "patch-service",
+			Target: Target{
+				PatchTarget: types.PatchTarget{
+					Gvk: gvk.Gvk{
+						Group:   "",
+						Version: "v1",
+						Kind:    "Service",
+					},
+					Namespace: "default",
+					Name:      "test-svc",
+				},
+			},
+			Up: []Patch{
+				{
+					Type:   "application/json-patch+json",
+					Change: `[{"op":"replace","path":"/spec/ports/0/targetPort","value":9371},{"op":"add","path":"/metadata/labels","value":{"migrated":"true"}}]`,
+				},
+			},
+		},
+	}
+
+	if err := MigrateDirectoryUp(dir, migrations); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `# The frontend service.
+apiVersion: v1
+kind: Service
+metadata:
+  name: test-svc
+  namespace: default
+  labels:
+    migrated: "true"
+spec:
+  selector:
+    app.kubernetes.io/name: frontend # selects the frontend pods
+  ports:
+    - name: http-80
+      protocol: TCP
+      port: 80 # the public port
+      targetPort: 9371
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: other-svc
+  namespace: default
+spec:
+  ports:
+    - name: http-80
+      protocol: TCP
+      port: 80
+      targetPort: 9376
+`
+	if diff := cmp.Diff(want, readFile(t, filepath.Join(dir, "services.yaml"))); diff != "" {
+		t.Fatalf("failed to migrate file:\n%s", diff)
+	}
+	if diff := cmp.Diff(readFile(t, "testdata/manifests/apps/configmap.yaml"), readFile(t, filepath.Join(dir, "apps/configmap.yaml"))); diff != "" {
+		t.Fatalf("unmatched file was changed:\n%s", diff)
+	}
+}
+
+func TestMigrateDirectoryDown(t *testing.T) {
+	dir := copyManifests(t, "testdata/manifests")
+	migrations := []Migration{
+		{
+			Name: "patch-configmap",
+			Target: Target{
+				PatchTarget: types.PatchTarget{
+					Gvk: gvk.Gvk{
+						Version: "v1",
+						Kind:    "ConfigMap",
+					},
+				},
+			},
+			Up: []Patch{
+				{
+					Type:   "application/merge-patch+json",
+					Change: `{"data":{"testing":"new-value"}}`,
+				},
+			},
+			Down: []Patch{
+				{
+					Type:   "application/merge-patch+json",
+					Change: `{"data":{"testing":"old-value"}}`,
+				},
+			},
+		},
+	}
+
+	if err := MigrateDirectoryDown(dir, migrations); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: test-cm
+  namespace: default
+data:
+  testing: old-value
+`
+	if diff := cmp.Diff(want, readFile(t, filepath.Join(dir, "apps/configmap.yaml"))); diff != "" {
+		t.Fatalf("failed to migrate file:\n%s", diff)
+	}
+}
+
+func TestMigrateDirectoryDown_limits(t *testing.T) {
+	migration := func(name string) Migration {
+		return Migration{
+			Name: name,
+			Target: Target{
+				PatchTarget: types.PatchTarget{
+					Gvk: gvk.Gvk{Version: "v1", Kind: "ConfigMap"},
+				},
+			},
+			Up: []Patch{
+				{
+					Type:   "application/merge-patch+json",
+					Change: `{"data":{"` + name + `":"migrated"}}`,
+				},
+			},
+			Down: []Patch{
+				{
+					Type:   "application/merge-patch+json",
+					Change: `{"data":{"` + name + `":"reverted"}}`,
+				},
+			},
+		}
+	}
+	migrations := []Migration{migration("first"), migration("second")}
+
+	limitTests := []struct {
+		name    string
+		opts    []Option
+		want    map[string]any
+		wantErr string
+	}{
+		{
+			name: "steps",
+			opts: []Option{WithDownSteps(1)},
+			want: map[string]any{"testing": "test", "second": "reverted"},
+		},
+		{
+			name: "to",
+			opts: []Option{WithDownTo("first")},
+			want: map[string]any{"testing": "test", "second": "reverted"},
+		},
+		{
+			name: "all",
+			want: map[string]any{"testing": "test", "first": "reverted", "second": "reverted"},
+		},
+		{
+			name:    "unknown migration",
+			opts:    []Option{WithDownTo("unknown")},
+			wantErr: "migration unknown is not an applied migration",
+		},
+	}
+
+	for _, tt := range limitTests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := copyManifests(t, "testdata/manifests")
+
+			err := MigrateDirectoryDown(dir, migrations, tt.opts...)
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+
+			var cm map[string]any
+			assert.NoError(t, yaml.Unmarshal([]byte(readFile(t, filepath.Join(dir, "apps/configmap.yaml"))), &cm))
+			assert.Equal(t, tt.want, cm["data"])
+		})
+	}
+}
+
+func TestMigrateDirectoryUp_bad_patch(t *testing.T) {
+	dir := copyManifests(t, "testdata/manifests")
+	migrations := []Migration{
+		{
+			Name: "patch-configmap",
+			Target: Target{
+				PatchTarget: types.PatchTarget{
+					Gvk: gvk.Gvk{
+						Version: "v1",
+						Kind:    "ConfigMap",
+					},
+				},
+			},
+			Up: []Patch{
+				{
+					Type:   "application/json-patch+json",
+					Change: `[{"op":"replace","path":"/data/unknown","value":"new-value"}]`,
+				},
+			},
+		},
+	}
+
+	err := MigrateDirectoryUp(dir, migrations)
+	assert.ErrorContains(t, err, "migrating ConfigMap test-cm in "+filepath.Join(dir, "apps/configmap.yaml"))
+}
+
+func TestMigrateDirectoryUp_unchanged_resources(t *testing.T) {
+	dir := t.TempDir()
+	manifest := `apiVersion: v1
+kind: ConfigMap
+metadata: {name: test-cm, namespace: default}
+data:
+  testing: "test"
+---
+# Documents that are not resources are skipped.
+settings:
+  enabled: true
+`
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "configmap.yaml"), []byte(manifest), 0o644))
+	migrations := []Migration{
+		{
+			Name: "patch-configmap",
+			Target: Target{
+				PatchTarget: types.PatchTarget{
+					Gvk: gvk.Gvk{
+						Version: "v1",
+						Kind:    "ConfigMap",
+					},
+				},
+			},
+			Up: []Patch{
+				{
+					Type:   "application/merge-patch+json",
+					Change: `{"data":{"testing":"test"}}`,
+				},
+			},
+		},
+	}
+
+	if err := MigrateDirectoryUp(dir, migrations); err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff(manifest, readFile(t, filepath.Join(dir, "configmap.yaml"))); diff != "" {
+		t.Fatalf("unchanged file was rewritten:\n%s", diff)
+	}
+
+	var out bytes.Buffer
+	assert.NoError(t, DiffDirectory(dir, migrations, &out))
+	assert.Empty(t, out.String())
+}
+
+func TestMigrateDirectoryUp_dry_run(t *testing.T) {
+	dir := copyManifests(t, "testdata/manifests")
+	migrations := []Migration{
+		{
+			Name: "patch-service",
+			Target: Target{
+				PatchTarget: types.PatchTarget{
+					Gvk: gvk.Gvk{
+						Version: "v1",
+						Kind:    "Service",
+					},
+					Namespace: "default",
+					Name:      "test-svc",
+				},
+			},
+			Up: []Patch{
+				{
+					Type:   "application/merge-patch+json",
+					Change: `{"metadata":{"labels":{"migrated":"true"}}}`,
+				},
+			},
+		},
+	}
+
+	t.Run("client", func(t *testing.T) {
+		var out bytes.Buffer
+		if err := MigrateDirectoryUp(dir, migrations, WithDryRun(DryRunClient), WithOutput(&out)); err != nil {
+			t.Fatal(err)
+		}
+
+		assert.Equal(t, "Service default/test-svc: {\"metadata\":{\"labels\":{\"migrated\":\"true\"}}}\n", out.String())
+		if diff := cmp.Diff(readFile(t, "testdata/manifests/services.yaml"), readFile(t, filepath.Join(dir, "services.yaml"))); diff != "" {
+			t.Fatalf("file was changed in a dry-run:\n%s", diff)
+		}
+	})
+
+	t.Run("server", func(t *testing.T) {
+		err := MigrateDirectoryUp(dir, migrations, WithDryRun(DryRunServer))
+		assert.ErrorContains(t, err, "a server dry-run cannot be used to migrate files")
+	})
+}
+
+func TestMigrateDirectoryUp_missing_dir(t *testing.T) {
+	err := MigrateDirectoryUp("testdata/unknown", nil)
+	assert.ErrorContains(t, err, "reading manifests in testdata/unknown")
+}
+
+func copyManifests(t *testing.T, src string) string {
+	t.Helper()
+	dir := t.TempDir()
+	err := filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() {
+			return os.MkdirAll(filepath.Join(dir, rel), 0o755)
+		}
+
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		return os.WriteFile(filepath.Join(dir, rel), b, 0o644)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return dir
+}
+
+func readFile(t *testing.T, filename string) string {
+	t.Helper()
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(b)
+}
@@ -0,0 +1,148 @@
+package migrator
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/bigkevmcd/migrator/pkg/api/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// WithMigrationRecords enables the creation of a MigrationRecord for each
+// migration that is applied.
+//
+// The client used to migrate must have the v1alpha1 types registered in its
+// scheme.
+func WithMigrationRecords() Option {
+	return func(o *options) {
+		o.migrationRecords = true
+	}
+}
+
+// maxRecordNamePrefix is the maximum length of the migration name in the
+// generated name of a MigrationRecord, leaving room for the direction and the
+// random suffix.
+const maxRecordNamePrefix = 200
+
+// maxRecordedResources is the maximum number of resources that are listed in
+// a MigrationRecord, a record listing every resource of a large migration
+// would exceed the size limit of a resource.
+const maxRecordedResources = 1000
+
+// historyRecorder keeps the MigrationRecord for a migration up to date.
+//
+// A nil historyRecorder records nothing.
+type historyRecorder struct {
+	mu         sync.Mutex
+	kubeClient client.Client
+	record     *v1alpha1.MigrationRecord
+	pending    bool
+}
+
+func startHistory(ctx context.Context, kubeClient client.Client, migration Migration, direction v1alpha1.Direction) (*historyRecorder, error) {
+	record := &v1alpha1.MigrationRecord{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: fmt.Sprintf("%s-%s-", recordName(migration.Name), strings.ToLower(string(direction))),
+		},
+		Spec: v1alpha1.MigrationRecordSpec{
+			Migration: migration.Name,
+			Filename:  migration.Filename,
+			Direction: direction,
+			Outcome:   v1alpha1.OutcomeInProgress,
+			StartedAt: metav1.Now(),
+		},
+	}
+
+	if err := kubeClient.Create(ctx, record); err != nil {
+		return nil, fmt.Errorf("creating migration record for %s: %w", migration.Name, err)
+	}
+
+	return &historyRecorder{kubeClient: kubeClient, record: record}, nil
+}
+
+// recordName returns a name for the MigrationRecord of a migration, migration
+// names can have characters that are not valid in resource names.
+func recordName(migrationName string) string {
+	name := strings.Trim(invalidNameChars.ReplaceAllString(strings.ToLower(migrationName), "-"), "-")
+	if len(name) > maxRecordNamePrefix {
+		name = strings.TrimRight(name[:maxRecordNamePrefix], "-")
+	}
+
+	return cmp.Or(name, "migration")
+}
+
+// migrated adds the resource to the resources that have been patched, the
+// record is updated when it is flushed.
+//
+// All the resources are counted, but only the first maxRecordedResources are
+// listed.
+func (h *historyRecorder) migrated(resource *unstructured.Unstructured) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.record.Spec.ResourceCount++
+	h.pending = true
+	if len(h.record.Spec.Resources) >= maxRecordedResources {
+		return
+	}
+
+	gvk := resource.GroupVersionKind()
+	h.record.Spec.Resources = append(h.record.Spec.Resources, v1alpha1.MigratedResource{
+		Group:           gvk.Group,
+		Version:         gvk.Version,
+		Kind:            gvk.Kind,
+		Namespace:       resource.GetNamespace(),
+		Name:            resource.GetName(),
+		ResourceVersion: resource.GetResourceVersion(),
+	})
+}
+
+// flush updates the record with the resources that have been patched since it
+// was last updated.
+func (h *historyRecorder) flush(ctx context.Context) error {
+	if h == nil {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if !h.pending {
+		return nil
+	}
+
+	return h.update(ctx)
+}
+
+// complete records the outcome of the migration.
+func (h *historyRecorder) complete(ctx context.Context, migrationErr error) error {
+	if h == nil {
+		return nil
+	}
+
+	now := metav1.Now()
+	h.record.Spec.CompletedAt = &now
+	h.record.Spec.Outcome = v1alpha1.OutcomeSucceeded
+	if migrationErr != nil {
+		h.record.Spec.Outcome = v1alpha1.OutcomeFailed
+		h.record.Spec.Message = migrationErr.Error()
+	}
+
+	return h.update(ctx)
+}
+
+func (h *historyRecorder) update(ctx context.Context) error {
+	h.pending = false
+	if err := h.kubeClient.Update(ctx, h.record); err != nil {
+		return fmt.Errorf("updating migration record %s: %w", h.record.GetName(), err)
+	}
+
+	return nil
+}
@@ -0,0 +1,261 @@
+package migrator
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/bigkevmcd/migrator/pkg/api/v1alpha1"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+	"sigs.k8s.io/kustomize/v3/pkg/gvk"
+	"sigs.k8s.io/kustomize/v3/pkg/types"
+)
+
+func TestMigrateUp_with_migration_records(t *testing.T) {
+	migrations := []Migration{
+		{
+			Name:     "patch-service",
+			Filename: "testdata/simple.yaml",
+			Target: Target{
+				PatchTarget: types.PatchTarget{
+					Gvk: gvk.Gvk{
+						Group:   "",
+						Version: "v1",
+						Kind:    "Service",
+					},
+					Namespace: "default",
+					Name:      "test-svc",
+				},
+			},
+			Up: []Patch{
+				{
+					Type:   "application/json-patch+json",
+					Change: `[{"op":"replace","path":"/spec/ports/0/port","value":81}]`,
+				},
+			},
+		},
+	}
+	fc := newFakeClientWithRecords(t, newService())
+
+	if err := MigrateUp(context.TODO(), fc, migrations, WithMigrationRecords()); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []v1alpha1.MigrationRecordSpec{
+		{
+			Migration: "patch-service",
+			Filename:  "testdata/simple.yaml",
+			Direction: v1alpha1.DirectionUp,
+			Resources: []v1alpha1.MigratedResource{
+				{
+					Version:         "v1",
+					Kind:            "Service",
+					Namespace:       "default",
+					Name:            "test-svc",
+					ResourceVersion: "1000",
+				},
+			},
+			ResourceCount: 1,
+			Outcome:       v1alpha1.OutcomeSucceeded,
+		},
+	}
+	if diff := cmp.Diff(want, listRecordSpecs(t, fc), ignoreRecordTimes()); diff != "" {
+		t.Errorf("failed to record migration:\n%s", diff)
+	}
+}
+
+func TestMigrateUp_with_migration_records_failure(t *testing.T) {
+	migrations := []Migration{
+		{
+			Name:     "patch-service",
+			Filename: "testdata/simple.yaml",
+			Target: Target{
+				PatchTarget: types.PatchTarget{
+					Gvk: gvk.Gvk{
+						Group:   "",
+						Version: "v1",
+						Kind:    "Service",
+					},
+					Namespace: "default",
+					Name:      "test-svc",
+				},
+			},
+			Up: []Patch{
+				{
+					Type:   "application/json-patch+json",
+					Change: `[{"op":"replace","path":"/spec/sports/0/port","value":81}]`,
+				},
+			},
+		},
+	}
+	fc := newFakeClientWithRecords(t, newService())
+
+	err := MigrateUp(context.TODO(), fc, migrations, WithMigrationRecords())
+	assert.ErrorContains(t, err, "replace operation does not apply")
+
+	want := []v1alpha1.MigrationRecordSpec{
+		{
+			Migration: "patch-service",
+			Filename:  "testdata/simple.yaml",
+			Direction: v1alpha1.DirectionUp,
+			Outcome:   v1alpha1.OutcomeFailed,
+			Message:   "migration patch-service: Service default/test-svc: replace operation does not apply: doc is missing path: /spec/sports/0/port: missing value",
+		},
+	}
+	if diff := cmp.Diff(want, listRecordSpecs(t, fc), ignoreRecordTimes()); diff != "" {
+		t.Errorf("failed to record migration:\n%s", diff)
+	}
+}
+
+func TestMigrateUp_with_migration_records_batches(t *testing.T) {
+	migrations := []Migration{
+		{
+			Name: "Migrate_ConfigMaps",
+			Target: Target{
+				PatchTarget: types.PatchTarget{
+					Gvk: gvk.Gvk{
+						Version: "v1",
+						Kind:    "ConfigMap",
+					},
+					Namespace: "default",
+				},
+			},
+			Up: []Patch{
+				{
+					Type:   "application/merge-patch+json",
+					Change: `{"data":{"migrated":"true"}}`,
+				},
+			},
+		},
+	}
+	var objs []client.Object
+	for i := 0; i < 5; i++ {
+		objs = append(objs, newConfigMap(func(cm *corev1.ConfigMap) {
+			cm.SetName(fmt.Sprintf("test-cm-%d", i))
+		}))
+	}
+	var updates int
+	fc := newFakeClientWithRecords(t, objs...)
+	fc = interceptor.NewClient(fc.(client.WithWatch), interceptor.Funcs{
+		Update: func(ctx context.Context, c client.WithWatch, obj client.Object, opts ...client.UpdateOption) error {
+			if _, ok := obj.(*v1alpha1.MigrationRecord); ok {
+				updates++
+			}
+
+			return c.Update(ctx, obj, opts...)
+		},
+	})
+
+	if err := MigrateUp(context.TODO(), fc, migrations, WithMigrationRecords(), WithBatchSize(2)); err != nil {
+		t.Fatal(err)
+	}
+
+	var records v1alpha1.MigrationRecordList
+	if err := fc.List(context.TODO(), &records); err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, records.Items, 1)
+	assert.Equal(t, "migrate-configmaps-up-", records.Items[0].GetGenerateName())
+	assert.Len(t, records.Items[0].Spec.Resources, 5)
+	assert.Equal(t, 5, records.Items[0].Spec.ResourceCount)
+	// One update for each of the three batches, and one for the outcome.
+	assert.Equal(t, 4, updates)
+}
+
+func TestMigrateUp_with_migration_records_many_resources(t *testing.T) {
+	migrations := []Migration{
+		{
+			Name: "migrate-configmaps",
+			Target: Target{
+				PatchTarget: types.PatchTarget{
+					Gvk: gvk.Gvk{
+						Version: "v1",
+						Kind:    "ConfigMap",
+					},
+					Namespace: "default",
+				},
+			},
+			Up: []Patch{
+				{
+					Type:   "application/merge-patch+json",
+					Change: `{"data":{"migrated":"true"}}`,
+				},
+			},
+		},
+	}
+	var objs []client.Object
+	for i := 0; i < maxRecordedResources+5; i++ {
+		objs = append(objs, newConfigMap(func(cm *corev1.ConfigMap) {
+			cm.SetName(fmt.Sprintf("test-cm-%d", i))
+		}))
+	}
+	fc := newFakeClientWithRecords(t, objs...)
+
+	if err := MigrateUp(context.TODO(), fc, migrations, WithMigrationRecords(), WithBatchSize(500)); err != nil {
+		t.Fatal(err)
+	}
+
+	var records v1alpha1.MigrationRecordList
+	if err := fc.List(context.TODO(), &records); err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, records.Items, 1)
+	assert.Len(t, records.Items[0].Spec.Resources, maxRecordedResources)
+	assert.Equal(t, maxRecordedResources+5, records.Items[0].Spec.ResourceCount)
+}
+
+func TestRecordName(t *testing.T) {
+	nameTests := []struct {
+		name string
+		want string
+	}{
+		{name: "patch-service", want: "patch-service"},
+		{name: "Add_Item", want: "add-item"},
+		{name: "v1.2_rename", want: "v1-2-rename"},
+		{name: "__", want: "migration"},
+		{name: strings.Repeat("a", 250), want: strings.Repeat("a", maxRecordNamePrefix)},
+	}
+
+	for _, tt := range nameTests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, recordName(tt.name))
+		})
+	}
+}
+
+func newFakeClientWithRecords(t *testing.T, objs ...client.Object) client.Client {
+	t.Helper()
+	scheme := runtime.NewScheme()
+	assert.NoError(t, clientgoscheme.AddToScheme(scheme))
+	assert.NoError(t, v1alpha1.AddToScheme(scheme))
+
+	return fake.NewClientBuilder().
+		WithScheme(scheme).
+		WithObjects(objs...).
+		Build()
+}
+
+func listRecordSpecs(t *testing.T, kubeClient client.Client) []v1alpha1.MigrationRecordSpec {
+	t.Helper()
+	var records v1alpha1.MigrationRecordList
+	if err := kubeClient.List(context.TODO(), &records); err != nil {
+		t.Fatal(err)
+	}
+
+	return collect(records.Items, func(r v1alpha1.MigrationRecord) v1alpha1.MigrationRecordSpec {
+		return r.Spec
+	})
+}
+
+func ignoreRecordTimes() cmp.Option {
+	return cmpopts.IgnoreFields(v1alpha1.MigrationRecordSpec{}, "StartedAt", "CompletedAt")
+}
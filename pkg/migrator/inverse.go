@@ -0,0 +1,355 @@
+package migrator
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"gomodules.xyz/jsonpatch/v2"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// InversePatch is a JSON patch that reverts the changes that a migration made
+// to a resource.
+//
+// Inverse patches are stored for migrations without Down patches, and are
+// applied when the migration is migrated down.
+type InversePatch struct {
+	APIVersion string          `json:"apiVersion"`
+	Kind       string          `json:"kind"`
+	Namespace  string          `json:"namespace,omitempty"`
+	Name       string          `json:"name"`
+	Patch      json.RawMessage `json:"patch"`
+}
+
+func (p InversePatch) resource() *unstructured.Unstructured {
+	u := &unstructured.Unstructured{}
+	u.SetAPIVersion(p.APIVersion)
+	u.SetKind(p.Kind)
+	u.SetNamespace(p.Namespace)
+	u.SetName(p.Name)
+
+	return u
+}
+
+const (
+	inverseSecretPrefix = "migrator-inverse-"
+	inverseLabel        = "migrator.gitops.tools/inverse"
+)
+
+// InversePatchStore stores the inverse patches of migrations without Down
+// patches.
+type InversePatchStore interface {
+	// Append adds inverse patches for the named migration.
+	Append(ctx context.Context, migrationName string, patches []InversePatch) error
+
+	// Load returns the inverse patches for the named migration, a NotFound
+	// error is returned if there are none.
+	Load(ctx context.Context, migrationName string) ([]InversePatch, error)
+
+	// Delete removes the inverse patches for the named migration.
+	Delete(ctx context.Context, migrationName string) error
+}
+
+// NewSecretInversePatchStore creates and returns an InversePatchStore that
+// stores each migration's inverse patches in Secrets in the provided
+// namespace.
+func NewSecretInversePatchStore(kubeClient client.Client, namespace string) *SecretInversePatchStore {
+	return &SecretInversePatchStore{chunks: secretChunks{
+		kubeClient: kubeClient,
+		namespace:  namespace,
+		prefix:     inverseSecretPrefix,
+		label:      inverseLabel,
+	}}
+}
+
+// SecretInversePatchStore is an InversePatchStore that keeps inverse patches
+// in Secrets, because they contain the original values of the fields that
+// were migrated, which may be sensitive.
+//
+// The inverse patches for many resources are split across several Secrets,
+// which are named with a hash of the migration name.
+type SecretInversePatchStore struct {
+	chunks secretChunks
+}
+
+// Append implements the InversePatchStore interface.
+func (s *SecretInversePatchStore) Append(ctx context.Context, migrationName string, patches []InversePatch) error {
+	return appendChunks(ctx, s.chunks, migrationName, patches)
+}
+
+// Load implements the InversePatchStore interface.
+func (s *SecretInversePatchStore) Load(ctx context.Context, migrationName string) ([]InversePatch, error) {
+	return loadChunks[InversePatch](ctx, s.chunks, migrationName)
+}
+
+// Delete implements the InversePatchStore interface.
+func (s *SecretInversePatchStore) Delete(ctx context.Context, migrationName string) error {
+	if err := s.chunks.delete(ctx, migrationName); err != nil {
+		return fmt.Errorf("deleting inverse patches for migration %s: %w", migrationName, err)
+	}
+
+	return nil
+}
+
+// inverseRecorder keeps the inverse patches for the resources that have been
+// patched by a migration, until they are flushed to the InversePatchStore.
+//
+// A nil inverseRecorder keeps nothing.
+type inverseRecorder struct {
+	store     InversePatchStore
+	migration Migration
+
+	mu      sync.Mutex
+	inverse []InversePatch
+}
+
+func newInverseRecorder(store InversePatchStore, migration Migration) *inverseRecorder {
+	return &inverseRecorder{store: store, migration: migration}
+}
+
+// migrated keeps the inverse patch from the updated version of a resource
+// to the original.
+func (r *inverseRecorder) migrated(original, updated *unstructured.Unstructured) error {
+	if r == nil || original == nil {
+		return nil
+	}
+
+	patch, err := inverseJSONPatch(original, updated)
+	if err != nil {
+		return fmt.Errorf("calculating inverse patch for %s %s: %w", original.GetKind(), client.ObjectKeyFromObject(original), err)
+	}
+	if patch == nil {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.inverse = append(r.inverse, InversePatch{
+		APIVersion: original.GetAPIVersion(),
+		Kind:       original.GetKind(),
+		Namespace:  original.GetNamespace(),
+		Name:       original.GetName(),
+		Patch:      patch,
+	})
+
+	return nil
+}
+
+// flush adds the inverse patches that have been kept to the store, sorted by
+// resource.
+//
+// The patches are added to any that were stored by an earlier run of the
+// migration that failed, the resources patched by that run are patched again
+// and have an inverse patch from each run, which are combined when the
+// migration is reverted.
+func (r *inverseRecorder) flush(ctx context.Context) error {
+	if r == nil {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.inverse) == 0 {
+		return nil
+	}
+
+	slices.SortFunc(r.inverse, func(a, b InversePatch) int {
+		return cmp.Or(
+			cmp.Compare(a.Kind, b.Kind),
+			cmp.Compare(a.Namespace, b.Namespace),
+			cmp.Compare(a.Name, b.Name))
+	})
+	if err := r.store.Append(ctx, r.migration.Name, r.inverse); err != nil {
+		return fmt.Errorf("storing inverse patches for migration %s: %w", r.migration.Name, err)
+	}
+	r.inverse = nil
+
+	return nil
+}
+
+// loadInversePatches returns the inverse patches for a migration from the
+// InversePatchStore, nil is returned if there are none.
+func loadInversePatches(ctx context.Context, o *options, migration Migration) ([]InversePatch, error) {
+	if o.inverseStore == nil {
+		return nil, nil
+	}
+
+	inverses, err := o.inverseStore.Load(ctx, migration.Name)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("loading inverse patches for migration %s: %w", migration.Name, err)
+	}
+
+	return inverses, nil
+}
+
+// inverseJSONPatch returns a JSON patch from the updated version of a
+// resource to the original, or nil if they are the same.
+//
+// The fields that are managed by the API server are not compared.
+func inverseJSONPatch(original, updated *unstructured.Unstructured) (json.RawMessage, error) {
+	from, err := comparableJSON(updated)
+	if err != nil {
+		return nil, err
+	}
+	to, err := comparableJSON(original)
+	if err != nil {
+		return nil, err
+	}
+
+	operations, err := jsonpatch.CreatePatch(from, to)
+	if err != nil {
+		return nil, err
+	}
+	if len(operations) == 0 {
+		return nil, nil
+	}
+
+	// The operations for the fields of objects are in the random order of the
+	// fields in the maps, the order of the operations on lists is kept.
+	slices.SortStableFunc(operations, func(a, b jsonpatch.Operation) int {
+		return cmp.Compare(operationField(a.Path), operationField(b.Path))
+	})
+
+	return json.Marshal(operations)
+}
+
+// operationField returns the path to the field that is changed, up to the
+// first index in a list.
+func operationField(path string) string {
+	parts := strings.Split(path, "/")
+	for i, part := range parts {
+		if _, err := strconv.Atoi(part); err == nil {
+			return strings.Join(parts[:i], "/")
+		}
+	}
+
+	return path
+}
+
+func comparableJSON(u *unstructured.Unstructured) ([]byte, error) {
+	c := u.DeepCopy()
+	for _, field := range []string{"resourceVersion", "generation", "managedFields", "uid", "creationTimestamp", "selfLink"} {
+		unstructured.RemoveNestedField(c.Object, "metadata", field)
+	}
+	delete(c.Object, "status")
+
+	return c.MarshalJSON()
+}
+
+// inversePatches returns the inverse patches as JSON patches.
+func inversePatches(inverses []InversePatch) []Patch {
+	patches := make([]Patch, len(inverses))
+	for i, inverse := range inverses {
+		patches[i] = Patch{Type: jsonPatchType, Change: string(inverse.Patch)}
+	}
+
+	return patches
+}
+
+// combineInversePatches returns one inverse patch for each resource, in the
+// order that the resources were first patched.
+//
+// A resource that was patched by more than one run of a migration has an
+// inverse patch from each run, the operations of the latest patch are applied
+// first, so that each patch is applied to the version it was calculated from.
+func combineInversePatches(inverses []InversePatch) ([]InversePatch, error) {
+	var combined []InversePatch
+	index := map[resourceKey]int{}
+	for _, inverse := range inverses {
+		key := keyOf(inverse.resource())
+		i, ok := index[key]
+		if !ok {
+			index[key] = len(combined)
+			combined = append(combined, inverse)
+			continue
+		}
+
+		var operations, earlier []json.RawMessage
+		if err := json.Unmarshal(inverse.Patch, &operations); err != nil {
+			return nil, fmt.Errorf("parsing inverse patch for %s %s/%s: %w", inverse.Kind, inverse.Namespace, inverse.Name, err)
+		}
+		if err := json.Unmarshal(combined[i].Patch, &earlier); err != nil {
+			return nil, fmt.Errorf("parsing inverse patch for %s %s/%s: %w", inverse.Kind, inverse.Namespace, inverse.Name, err)
+		}
+		patch, err := json.Marshal(append(operations, earlier...))
+		if err != nil {
+			return nil, err
+		}
+		combined[i].Patch = patch
+	}
+
+	return combined, nil
+}
+
+// revertResources applies the inverse patches that were recorded when the
+// migration was applied to the resources that still exist.
+func revertResources(ctx context.Context, kubeClient client.Client, o *options, migration Migration, inverses []InversePatch, history *historyRecorder) error {
+	inverses, err := combineInversePatches(inverses)
+	if err != nil {
+		return fmt.Errorf("reverting migration %s: %w", migration.Name, err)
+	}
+
+	var failed failures
+	for _, inverse := range inverses {
+		if o.limiter != nil {
+			if err := o.limiter.Wait(ctx); err != nil {
+				return err
+			}
+		}
+
+		resource := inverse.resource()
+		current, err := refetchResource(ctx, kubeClient, resource)
+		if err != nil {
+			if apierrors.IsNotFound(err) {
+				if err := reportSkipped(o.out, resource, "resource no longer exists"); err != nil {
+					return err
+				}
+				continue
+			}
+
+			return err
+		}
+
+		updated, _, err := patchResource(ctx, kubeClient, o, current, inversePatches([]InversePatch{inverse}))
+		if err != nil {
+			resourceErr := &ResourceError{
+				Migration:        migration.Name,
+				GroupVersionKind: resource.GroupVersionKind(),
+				Key:              client.ObjectKeyFromObject(resource),
+				Err:              err,
+			}
+			if o.keepGoing {
+				failed.add(resourceErr)
+				continue
+			}
+
+			return resourceErr
+		}
+
+		history.migrated(updated)
+	}
+
+	if err := o.reportProgress(migration, len(inverses), len(inverses)); err != nil {
+		return err
+	}
+
+	if len(failed.errs) > 0 {
+		return failed.errs
+	}
+
+	return nil
+}
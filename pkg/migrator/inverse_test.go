@@ -0,0 +1,423 @@
+package migrator
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+	"sigs.k8s.io/kustomize/v3/pkg/gvk"
+	"sigs.k8s.io/kustomize/v3/pkg/types"
+)
+
+func TestMigrateDown_inverse_patches(t *testing.T) {
+	migrations := []Migration{
+		{
+			Name:     "migrate-services",
+			Filename: "testdata/simple.yaml",
+			Target: Target{
+				PatchTarget: types.PatchTarget{
+					Gvk:       gvk.Gvk{Version: "v1", Kind: "Service"},
+					Namespace: "default",
+				},
+			},
+			Up: []Patch{
+				{
+					Type:   "application/json-patch+json",
+					Change: `[{"op":"replace","path":"/spec/ports/0/port","value":8080},{"op":"add","path":"/metadata/labels","value":{"migrated":"true"}}]`,
+				},
+			},
+		},
+	}
+
+	fc := fake.NewClientBuilder().WithObjects(
+		newService(),
+		newService(func(s *corev1.Service) { s.SetName("other-svc") }),
+	).Build()
+	store := NewConfigMapStateStore(fc, client.ObjectKey{Name: "migrator-state", Namespace: "default"})
+	inverseStore := NewSecretInversePatchStore(fc, "default")
+	if err := MigrateUp(context.TODO(), fc, migrations, WithStateStore(store), WithInversePatchStore(inverseStore)); err != nil {
+		t.Fatal(err)
+	}
+
+	inverses, err := inverseStore.Load(context.TODO(), "migrate-services")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []InversePatch{
+		{
+			APIVersion: "v1",
+			Kind:       "Service",
+			Namespace:  "default",
+			Name:       "other-svc",
+			Patch:      json.RawMessage(`[{"op":"remove","path":"/metadata/labels"},{"op":"replace","path":"/spec/ports/0/port","value":80}]`),
+		},
+		{
+			APIVersion: "v1",
+			Kind:       "Service",
+			Namespace:  "default",
+			Name:       "test-svc",
+			Patch:      json.RawMessage(`[{"op":"remove","path":"/metadata/labels"},{"op":"replace","path":"/spec/ports/0/port","value":80}]`),
+		},
+	}
+	if diff := cmp.Diff(want, inverses); diff != "" {
+		t.Fatalf("failed to record inverse patches:\n%s", diff)
+	}
+
+	// A controller changes a field that the migration did not change.
+	var svc corev1.Service
+	assert.NoError(t, fc.Get(context.TODO(), client.ObjectKey{Name: "test-svc", Namespace: "default"}, &svc))
+	svc.SetAnnotations(map[string]string{"example.com/controller": "true"})
+	assert.NoError(t, fc.Update(context.TODO(), &svc))
+
+	if err := MigrateDown(context.TODO(), fc, migrations, WithStateStore(store), WithInversePatchStore(inverseStore)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"test-svc", "other-svc"} {
+		var svc corev1.Service
+		assert.NoError(t, fc.Get(context.TODO(), client.ObjectKey{Name: name, Namespace: "default"}, &svc))
+		assert.Empty(t, svc.GetLabels())
+		assert.Equal(t, int32(80), svc.Spec.Ports[0].Port)
+		if name == "test-svc" {
+			assert.Equal(t, map[string]string{"example.com/controller": "true"}, svc.GetAnnotations())
+		}
+	}
+
+	applied, err := store.Applied(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, applied)
+	_, err = inverseStore.Load(context.TODO(), "migrate-services")
+	assert.True(t, apierrors.IsNotFound(err))
+}
+
+func TestMigrateDown_inverse_patches_deleted_resource(t *testing.T) {
+	migrations := []Migration{
+		{
+			Name:     "migrate-service",
+			Filename: "testdata/simple.yaml",
+			Target: Target{
+				PatchTarget: types.PatchTarget{
+					Gvk:       gvk.Gvk{Version: "v1", Kind: "Service"},
+					Namespace: "default",
+					Name:      "test-svc",
+				},
+			},
+			Up: []Patch{
+				{
+					Type:   "application/json-patch+json",
+					Change: `[{"op":"replace","path":"/spec/ports/0/port","value":8080}]`,
+				},
+			},
+		},
+	}
+
+	fc := fake.NewClientBuilder().WithObjects(newService()).Build()
+	store := NewConfigMapStateStore(fc, client.ObjectKey{Name: "migrator-state", Namespace: "default"})
+	inverseStore := NewSecretInversePatchStore(fc, "default")
+	if err := MigrateUp(context.TODO(), fc, migrations, WithStateStore(store), WithInversePatchStore(inverseStore)); err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, fc.Delete(context.TODO(), newService()))
+
+	var out bytes.Buffer
+	if err := MigrateDown(context.TODO(), fc, migrations, WithStateStore(store), WithInversePatchStore(inverseStore), WithOutput(&out)); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "Service default/test-svc: skipped, resource no longer exists\n", out.String())
+}
+
+func TestMigrateUp_no_inverse_patches_with_down(t *testing.T) {
+	migrations := []Migration{
+		{
+			Name:     "migrate-service",
+			Filename: "testdata/simple.yaml",
+			Target: Target{
+				PatchTarget: types.PatchTarget{
+					Gvk:       gvk.Gvk{Version: "v1", Kind: "Service"},
+					Namespace: "default",
+					Name:      "test-svc",
+				},
+			},
+			Up: []Patch{
+				{
+					Type:   "application/json-patch+json",
+					Change: `[{"op":"replace","path":"/spec/ports/0/port","value":8080}]`,
+				},
+			},
+			Down: []Patch{
+				{
+					Type:   "application/json-patch+json",
+					Change: `[{"op":"replace","path":"/spec/ports/0/port","value":80}]`,
+				},
+			},
+		},
+	}
+
+	fc := fake.NewClientBuilder().WithObjects(newService()).Build()
+	store := NewConfigMapStateStore(fc, client.ObjectKey{Name: "migrator-state", Namespace: "default"})
+	inverseStore := NewSecretInversePatchStore(fc, "default")
+	if err := MigrateUp(context.TODO(), fc, migrations, WithStateStore(store), WithInversePatchStore(inverseStore)); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := inverseStore.Load(context.TODO(), "migrate-service")
+	assert.True(t, apierrors.IsNotFound(err))
+}
+
+func TestInverseJSONPatch(t *testing.T) {
+	original := toUnstructured(t, newService())
+	original.SetResourceVersion("1")
+
+	updated := toUnstructured(t, newService(func(s *corev1.Service) {
+		s.Spec.Ports[0].TargetPort = intstr.FromInt(8080)
+	}))
+	updated.SetResourceVersion("2")
+	updated.SetGeneration(2)
+
+	patch, err := inverseJSONPatch(original, updated)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `[{"op":"replace","path":"/spec/ports/0/targetPort","value":9376}]`, string(patch))
+
+	patch, err = inverseJSONPatch(original, original)
+	assert.NoError(t, err)
+	assert.Nil(t, patch)
+}
+
+func TestInverseJSONPatch_order(t *testing.T) {
+	original := toUnstructured(t, newConfigMap())
+	updated := toUnstructured(t, newConfigMap(func(cm *corev1.ConfigMap) {
+		cm.Data = map[string]string{"a": "1", "b": "2", "c": "3", "d": "4", "testing": "changed"}
+	}))
+
+	// The operations are in the same order every time.
+	for i := 0; i < 10; i++ {
+		patch, err := inverseJSONPatch(original, updated)
+		assert.NoError(t, err)
+		assert.Equal(t, `[{"op":"remove","path":"/data/a"},{"op":"remove","path":"/data/b"},{"op":"remove","path":"/data/c"},{"op":"remove","path":"/data/d"},{"op":"replace","path":"/data/testing","value":"test"}]`, string(patch))
+	}
+}
+
+func TestMigrateDown_inverse_patches_keep_going(t *testing.T) {
+	migrations := []Migration{
+		{
+			Name:     "label-service",
+			Filename: "testdata/simple.yaml",
+			Target: Target{
+				PatchTarget: types.PatchTarget{
+					Gvk:       gvk.Gvk{Version: "v1", Kind: "Service"},
+					Namespace: "default",
+					Name:      "test-svc",
+				},
+			},
+			Up: []Patch{
+				{
+					Type:   "application/json-patch+json",
+					Change: `[{"op":"add","path":"/metadata/labels","value":{"migrated":"true"}}]`,
+				},
+			},
+		},
+	}
+
+	fc := fake.NewClientBuilder().WithObjects(newService()).Build()
+	store := NewConfigMapStateStore(fc, client.ObjectKey{Name: "migrator-state", Namespace: "default"})
+	inverseStore := NewSecretInversePatchStore(fc, "default")
+	if err := MigrateUp(context.TODO(), fc, migrations, WithStateStore(store), WithInversePatchStore(inverseStore)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The inverse patch removes the labels, which fails if it is applied again.
+	err := MigrateDown(context.TODO(), fc, migrations, WithStateStore(store), WithInversePatchStore(inverseStore), WithKeepGoing())
+	assert.ErrorContains(t, err, "migration label-service cannot be executed with keep-going")
+
+	var svc corev1.Service
+	assert.NoError(t, fc.Get(context.TODO(), client.ObjectKey{Name: "test-svc", Namespace: "default"}, &svc))
+	assert.Equal(t, map[string]string{"migrated": "true"}, svc.GetLabels())
+}
+
+func TestMigrateUp_inverse_patches_for_secrets(t *testing.T) {
+	migrations := []Migration{
+		{
+			Name: "rotate-password",
+			Target: Target{
+				PatchTarget: types.PatchTarget{
+					Gvk:       gvk.Gvk{Version: "v1", Kind: "Secret"},
+					Namespace: "default",
+					Name:      "credentials",
+				},
+			},
+			Up: []Patch{
+				{
+					Type:   "application/json-patch+json",
+					Change: `[{"op":"replace","path":"/data/password","value":"bmV3LXBhc3N3b3Jk"}]`,
+				},
+			},
+		},
+	}
+	secret := &corev1.Secret{Data: map[string][]byte{"password": []byte("hunter2")}}
+	secret.SetName("credentials")
+	secret.SetNamespace("default")
+
+	fc := fake.NewClientBuilder().WithObjects(secret).Build()
+	store := NewConfigMapStateStore(fc, client.ObjectKey{Name: "migrator-state", Namespace: "default"})
+	inverseStore := NewSecretInversePatchStore(fc, "default")
+	if err := MigrateUp(context.TODO(), fc, migrations, WithStateStore(store), WithInversePatchStore(inverseStore)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The original value is not stored in the state ConfigMap.
+	var state corev1.ConfigMap
+	assert.NoError(t, fc.Get(context.TODO(), client.ObjectKey{Name: "migrator-state", Namespace: "default"}, &state))
+	assert.NotContains(t, state.Data["rotate-password"], "aHVudGVyMg==")
+
+	var secrets corev1.SecretList
+	assert.NoError(t, fc.List(context.TODO(), &secrets, client.HasLabels{inverseLabel}))
+	assert.Len(t, secrets.Items, 1)
+	assert.Contains(t, string(secrets.Items[0].Data[chunkKey]), "aHVudGVyMg==")
+
+	if err := MigrateDown(context.TODO(), fc, migrations, WithStateStore(store), WithInversePatchStore(inverseStore)); err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, fc.Get(context.TODO(), client.ObjectKeyFromObject(secret), secret))
+	assert.Equal(t, "hunter2", string(secret.Data["password"]))
+}
+
+func TestMigrateUp_inverse_patches_failed_migration(t *testing.T) {
+	migrations := []Migration{
+		{
+			Name: "migrate-configmaps",
+			Target: Target{
+				PatchTarget: types.PatchTarget{
+					Gvk:       gvk.Gvk{Version: "v1", Kind: "ConfigMap"},
+					Namespace: "default",
+				},
+			},
+			Up: []Patch{
+				{
+					Type:   "application/json-patch+json",
+					Change: `[{"op":"replace","path":"/data/testing","value":"migrated"}]`,
+				},
+			},
+		},
+	}
+	newClient := func() client.Client {
+		return fake.NewClientBuilder().WithObjects(
+			newConfigMap(func(cm *corev1.ConfigMap) { cm.SetName("test-cm-1") }),
+			newConfigMap(func(cm *corev1.ConfigMap) { cm.SetName("test-cm-2"); cm.Data = nil }),
+		).Build()
+	}
+
+	t.Run("running again after fixing the failures", func(t *testing.T) {
+		fc := newClient()
+		store := NewConfigMapStateStore(fc, client.ObjectKey{Name: "migrator-state", Namespace: "default"})
+		opts := []Option{WithStateStore(store), WithInversePatchStore(NewSecretInversePatchStore(fc, "default")), WithKeepGoing()}
+
+		var migrationErrs MigrationErrors
+		assert.ErrorAs(t, MigrateUp(context.TODO(), fc, migrations, opts...), &migrationErrs)
+		cm := configMapNamed(t, fc, "test-cm-2")
+		cm.Data = map[string]string{"testing": "test"}
+		assert.NoError(t, fc.Update(context.TODO(), cm))
+		assert.NoError(t, MigrateUp(context.TODO(), fc, migrations, opts...))
+
+		// The inverse patches of both runs are applied.
+		assert.NoError(t, MigrateDown(context.TODO(), fc, migrations, opts...))
+		for _, name := range []string{"test-cm-1", "test-cm-2"} {
+			assert.Equal(t, map[string]string{"testing": "test"}, configMapNamed(t, fc, name).Data)
+		}
+	})
+
+	t.Run("atomic", func(t *testing.T) {
+		fc := newClient()
+		store := NewConfigMapStateStore(fc, client.ObjectKey{Name: "migrator-state", Namespace: "default"})
+		inverseStore := NewSecretInversePatchStore(fc, "default")
+
+		err := MigrateUp(context.TODO(), fc, migrations, WithStateStore(store), WithInversePatchStore(inverseStore), WithAtomic())
+		assert.ErrorContains(t, err, "replace operation does not apply")
+
+		// The resources are restored, so there is nothing to revert.
+		_, err = inverseStore.Load(context.TODO(), "migrate-configmaps")
+		assert.True(t, apierrors.IsNotFound(err))
+	})
+}
+
+func TestMigrateDown_inverse_patches_from_each_run(t *testing.T) {
+	migrations := []Migration{
+		{
+			Name: "add-port",
+			Target: Target{
+				PatchTarget: types.PatchTarget{
+					Gvk:       gvk.Gvk{Version: "v1", Kind: "Service"},
+					Namespace: "default",
+				},
+			},
+			Up: []Patch{
+				{
+					Type:   "application/json-patch+json",
+					Change: `[{"op":"add","path":"/spec/ports/-","value":{"name":"https","port":443,"protocol":"TCP"}}]`,
+				},
+			},
+		},
+	}
+
+	failing := true
+	fc := fake.NewClientBuilder().WithObjects(
+		newService(withName("svc-1")),
+		newService(withName("svc-2")),
+	).WithInterceptorFuncs(interceptor.Funcs{
+		Patch: func(ctx context.Context, c client.WithWatch, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+			if failing && obj.GetName() == "svc-2" {
+				return errors.New("failed to patch")
+			}
+
+			return c.Patch(ctx, obj, patch, opts...)
+		},
+	}).Build()
+	store := NewConfigMapStateStore(fc, client.ObjectKey{Name: "migrator-state", Namespace: "default"})
+	opts := []Option{WithStateStore(store), WithInversePatchStore(NewSecretInversePatchStore(fc, "default"))}
+
+	assert.ErrorContains(t, MigrateUp(context.TODO(), fc, migrations, opts...), "failed to patch")
+
+	// svc-1 is patched again by the second run.
+	failing = false
+	assert.NoError(t, MigrateUp(context.TODO(), fc, migrations, opts...))
+	var svc corev1.Service
+	assert.NoError(t, fc.Get(context.TODO(), client.ObjectKey{Name: "svc-1", Namespace: "default"}, &svc))
+	assert.Len(t, svc.Spec.Ports, 3)
+
+	assert.NoError(t, MigrateDown(context.TODO(), fc, migrations, opts...))
+	for _, name := range []string{"svc-1", "svc-2"} {
+		assert.NoError(t, fc.Get(context.TODO(), client.ObjectKey{Name: name, Namespace: "default"}, &svc))
+		assert.Len(t, svc.Spec.Ports, 1, name)
+	}
+}
+
+func TestCombineInversePatches(t *testing.T) {
+	inverses := []InversePatch{
+		{APIVersion: "v1", Kind: "Service", Namespace: "default", Name: "svc-1", Patch: json.RawMessage(`[{"op":"remove","path":"/spec/ports/1"}]`)},
+		{APIVersion: "v1", Kind: "Service", Namespace: "default", Name: "svc-2", Patch: json.RawMessage(`[{"op":"remove","path":"/spec/ports/1"}]`)},
+		{APIVersion: "v1", Kind: "Service", Namespace: "default", Name: "svc-1", Patch: json.RawMessage(`[{"op":"remove","path":"/spec/ports/2"}]`)},
+	}
+
+	combined, err := combineInversePatches(inverses)
+	assert.NoError(t, err)
+
+	want := []InversePatch{
+		{APIVersion: "v1", Kind: "Service", Namespace: "default", Name: "svc-1", Patch: json.RawMessage(`[{"op":"remove","path":"/spec/ports/2"},{"op":"remove","path":"/spec/ports/1"}]`)},
+		{APIVersion: "v1", Kind: "Service", Namespace: "default", Name: "svc-2", Patch: json.RawMessage(`[{"op":"remove","path":"/spec/ports/1"}]`)},
+	}
+	if diff := cmp.Diff(want, combined); diff != "" {
+		t.Fatalf("failed to combine inverse patches:\n%s", diff)
+	}
+}
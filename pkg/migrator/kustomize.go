@@ -0,0 +1,342 @@
+package migrator
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	apitypes "k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/kustomize/v3/pkg/gvk"
+	"sigs.k8s.io/kustomize/v3/pkg/types"
+	"sigs.k8s.io/yaml"
+)
+
+var invalidNameChars = regexp.MustCompile(`[^a-z0-9]+`)
+
+// ImportKustomization converts the patchesStrategicMerge, patchesJson6902 and
+// patches of a kustomization file to migrations that are written to dir.
+//
+// Patches in files are referenced by path from the migrations, and inline
+// patches are copied to the migrations, as are the documents of patch files
+// with more than one patch. The migrations are versioned in the order of the
+// patches, after the migrations that are already in dir, and the filenames
+// are returned.
+func ImportKustomization(kustomization, dir string) ([]string, error) {
+	existing, err := existingMigrations(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	migrations, err := importKustomization(kustomization, dir, existing)
+	if err != nil {
+		return nil, err
+	}
+
+	// Nothing is written unless all the migrations can be.
+	for _, migration := range migrations {
+		if _, err := os.Lstat(migration.Filename); err == nil {
+			return nil, fmt.Errorf("writing migration %s: %s already exists", migration.Name, migration.Filename)
+		}
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("creating directory %s: %w", dir, err)
+	}
+
+	filenames := make([]string, len(migrations))
+	for i, migration := range migrations {
+		if err := writeMigration(migration); err != nil {
+			return nil, err
+		}
+		filenames[i] = migration.Filename
+	}
+
+	return filenames, nil
+}
+
+// existingMigrations returns the migrations that are already in dir, which
+// must be versioned for imported migrations to be added after them.
+func existingMigrations(dir string) ([]Migration, error) {
+	if _, err := os.Stat(dir); errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+
+	migrations, err := ParseDirectory(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(migrations) > 0 && migrations[0].Version == 0 {
+		return nil, fmt.Errorf("the migrations in %s are not versioned", dir)
+	}
+
+	return migrations, nil
+}
+
+func importKustomization(kustomization, dir string, existing []Migration) ([]Migration, error) {
+	b, err := os.ReadFile(kustomization)
+	if err != nil {
+		return nil, fmt.Errorf("reading kustomization: %w", err)
+	}
+
+	var k types.Kustomization
+	if err := yaml.Unmarshal(b, &k); err != nil {
+		return nil, fmt.Errorf("parsing kustomization %s: %w", kustomization, err)
+	}
+
+	imp := importer{kustomizationDir: filepath.Dir(kustomization), dir: dir, names: map[string]int{}}
+	for _, migration := range existing {
+		imp.existing = append(imp.existing, migration.Name)
+		imp.version = max(imp.version, migration.Version)
+	}
+	for _, p := range k.PatchesStrategicMerge {
+		// Inline patches are multi-line, and paths are not.
+		path, inline := string(p), ""
+		if strings.Contains(path, "\n") {
+			path, inline = "", string(p)
+		}
+		if err := imp.add(path, inline, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, p := range k.PatchesJson6902 {
+		if p.Target == nil {
+			return nil, errors.New("patchesJson6902 must have a target")
+		}
+		if err := imp.add(p.Path, p.Patch, &Target{PatchTarget: *p.Target}); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, p := range k.Patches {
+		var target *Target
+		if s := p.Target; s != nil {
+			target = &Target{
+				PatchTarget:        types.PatchTarget{Gvk: s.Gvk, Namespace: s.Namespace, Name: s.Name},
+				LabelSelector:      s.LabelSelector,
+				AnnotationSelector: s.AnnotationSelector,
+			}
+		}
+		if err := imp.add(p.Path, p.Patch, target); err != nil {
+			return nil, err
+		}
+	}
+
+	return imp.migrations, nil
+}
+
+// importer creates a migration for each patch in a kustomization.
+type importer struct {
+	kustomizationDir string
+	dir              string
+	names            map[string]int
+	migrations       []Migration
+	// existing are the names of the migrations that are already in dir.
+	existing []string
+	// version is the version of the last migration.
+	version uint64
+}
+
+// add creates a migration for a patch in a file or an inline patch, and a
+// migration for each document in a patch file with more than one patch.
+func (i *importer) add(path, inline string, target *Target) error {
+	source, content := "inline patch", []byte(inline)
+	if path != "" {
+		source = path
+		b, err := os.ReadFile(filepath.Join(i.kustomizationDir, path))
+		if err != nil {
+			return fmt.Errorf("reading patch file: %w", err)
+		}
+		content = b
+	}
+
+	docs, err := yamlDocuments(content)
+	if err != nil {
+		return fmt.Errorf("parsing %s: %w", source, err)
+	}
+	if len(docs) == 0 {
+		return fmt.Errorf("%s has no patch", source)
+	}
+	if len(docs) == 1 {
+		return i.addPatch(source, path, docs[0], target, path != "")
+	}
+
+	// A patch file can only have one patch, so the documents are copied.
+	for n, change := range docs {
+		if err := i.addPatch(fmt.Sprintf("document %d of %s", n+1, source), path, change, target, false); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// addPatch creates a migration for a patch, which references the patch file
+// at path if byPath is true, and otherwise contains the change.
+//
+// Patches that are a list are JSON patches and other patches are strategic
+// merge patches, and if no target is provided, the target of a strategic
+// merge patch is the resource in the patch.
+func (i *importer) addPatch(source, path string, change []byte, target *Target, byPath bool) error {
+	patchType := apitypes.PatchType(strategicMergePatchType)
+	if bytes.HasPrefix(bytes.TrimSpace(change), []byte("[")) {
+		patchType = jsonPatchType
+	}
+
+	if target == nil {
+		if patchType == jsonPatchType {
+			return fmt.Errorf("%s is a JSON patch with no target", source)
+		}
+		var err error
+		if target, err = patchTarget(change); err != nil {
+			return fmt.Errorf("finding target of %s: %w", source, err)
+		}
+	}
+
+	var (
+		patch Patch
+		err   error
+	)
+	if byPath {
+		patch, err = i.pathPatch(patchType, path)
+	} else {
+		patch, err = inlinePatch(patchType, change)
+	}
+	if err != nil {
+		return err
+	}
+
+	name := i.migrationName(path, *target)
+	if slices.Contains(i.existing, name) {
+		return fmt.Errorf("migration %s already exists in %s", name, i.dir)
+	}
+	i.version++
+	i.migrations = append(i.migrations, Migration{
+		Filename: filepath.Join(i.dir, fmt.Sprintf("%04d_%s.yaml", i.version, strings.ReplaceAll(name, "-", "_"))),
+		Name:     name,
+		Version:  i.version,
+		Target:   *target,
+		Up:       []Patch{patch},
+	})
+
+	return nil
+}
+
+// pathPatch returns a patch that references a patch file, with a path that
+// is relative to the directory of the migrations.
+func (i *importer) pathPatch(patchType apitypes.PatchType, path string) (Patch, error) {
+	from, err := filepath.Abs(i.dir)
+	if err != nil {
+		return Patch{}, err
+	}
+	to, err := filepath.Abs(filepath.Join(i.kustomizationDir, path))
+	if err != nil {
+		return Patch{}, err
+	}
+
+	rel, err := filepath.Rel(from, to)
+	if err != nil {
+		return Patch{}, fmt.Errorf("finding path to %s: %w", path, err)
+	}
+
+	return Patch{Type: patchType, Path: filepath.ToSlash(rel)}, nil
+}
+
+func inlinePatch(patchType apitypes.PatchType, change []byte) (Patch, error) {
+	b, err := json.Marshal(patchJSON{Type: patchType, Change: change})
+	if err != nil {
+		return Patch{}, err
+	}
+
+	var patch Patch
+	if err := patch.UnmarshalJSON(b); err != nil {
+		return Patch{}, fmt.Errorf("parsing inline patch: %w", err)
+	}
+
+	return patch, nil
+}
+
+// patchTarget returns a target for the resource in a strategic merge patch.
+func patchTarget(change []byte) (*Target, error) {
+	var u unstructured.Unstructured
+	if err := u.UnmarshalJSON(change); err != nil {
+		return nil, err
+	}
+	if u.GetName() == "" {
+		return nil, errors.New("the patch has no name")
+	}
+
+	groupVersionKind := u.GroupVersionKind()
+
+	return &Target{
+		PatchTarget: types.PatchTarget{
+			Gvk: gvk.Gvk{
+				Group:   groupVersionKind.Group,
+				Version: groupVersionKind.Version,
+				Kind:    groupVersionKind.Kind,
+			},
+			Namespace: u.GetNamespace(),
+			Name:      u.GetName(),
+		},
+	}, nil
+}
+
+// migrationName returns a unique name for a migration from the name of the
+// patch file, or the target of an inline patch.
+func (i *importer) migrationName(path string, target Target) string {
+	name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	if path == "" {
+		name = strings.Join([]string{"patch", target.Kind, target.Name}, "-")
+	}
+	name = strings.Trim(invalidNameChars.ReplaceAllString(strings.ToLower(name), "-"), "-")
+
+	i.names[name]++
+	if n := i.names[name]; n > 1 {
+		name = fmt.Sprintf("%s-%d", name, n)
+	}
+
+	return name
+}
+
+// writeMigration writes a migration to its Filename, existing files are not
+// overwritten.
+func writeMigration(migration Migration) error {
+	target, err := json.Marshal(migration.Target)
+	if err != nil {
+		return err
+	}
+	var targetFields map[string]any
+	if err := json.Unmarshal(target, &targetFields); err != nil {
+		return err
+	}
+	if targetFields["name"] == "" {
+		delete(targetFields, "name")
+	}
+
+	b, err := yaml.Marshal(map[string]any{
+		"name":   migration.Name,
+		"target": targetFields,
+		"up":     migration.Up,
+	})
+	if err != nil {
+		return fmt.Errorf("encoding migration %s: %w", migration.Name, err)
+	}
+
+	f, err := os.OpenFile(migration.Filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return fmt.Errorf("writing migration %s: %w", migration.Name, err)
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return fmt.Errorf("writing migration %s: %w", migration.Name, err)
+	}
+
+	return f.Close()
+}
@@ -0,0 +1,207 @@
+package migrator
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestImportKustomization(t *testing.T) {
+	src := copyManifests(t, "testdata/kustomize")
+	dir := filepath.Join(src, "migrations")
+
+	filenames, err := ImportKustomization(filepath.Join(src, "kustomization.yaml"), dir)
+	assert.NoError(t, err)
+
+	want := []string{
+		filepath.Join(dir, "0001_replicas.yaml"),
+		filepath.Join(dir, "0002_service_port.yaml"),
+		filepath.Join(dir, "0003_patch_deployment_test_deployment.yaml"),
+		filepath.Join(dir, "0004_patch_service.yaml"),
+	}
+	if diff := cmp.Diff(want, filenames); diff != "" {
+		t.Fatalf("failed to import kustomization:\n%s", diff)
+	}
+
+	assert.Equal(t, `name: replicas
+target:
+  group: apps
+  kind: Deployment
+  name: test-deployment
+  version: v1
+up:
+- path: ../patches/replicas.yaml
+  type: application/strategic-merge-patch+json
+`, readFile(t, filenames[0]))
+	assert.Equal(t, `name: patch-service
+target:
+  kind: Service
+  labelSelector: app=test
+  version: v1
+up:
+- change:
+  - op: add
+    path: /metadata/annotations
+    value:
+      example.com/owner: platform
+  type: application/json-patch+json
+`, readFile(t, filenames[3]))
+
+	assert.NoError(t, ValidateDirectory(dir))
+	migrations, err := ParseDirectory(dir)
+	assert.NoError(t, err)
+
+	svc := toUnstructured(t, newService(withLabels(map[string]string{"app": "test"})))
+	updated, err := ApplyPatches(svc, migrations[1].Up)
+	assert.NoError(t, err)
+
+	var got corev1.Service
+	assert.NoError(t, runtime.DefaultUnstructuredConverter.FromUnstructured(updated.Object, &got))
+	assert.Equal(t, int32(8080), got.Spec.Ports[0].Port)
+}
+
+func TestImportKustomization_errors(t *testing.T) {
+	importTests := []struct {
+		name          string
+		kustomization string
+		wantErr       string
+	}{
+		{
+			name: "JSON patch without a target",
+			kustomization: `patches:
+  - patch: '[{"op": "remove", "path": "/spec/replicas"}]'
+`,
+			wantErr: "inline patch is a JSON patch with no target",
+		},
+		{
+			name: "patchesJson6902 without a target",
+			kustomization: `patchesJson6902:
+  - path: patch.yaml
+`,
+			wantErr: "patchesJson6902 must have a target",
+		},
+		{
+			name: "strategic merge patch without a name",
+			kustomization: `patchesStrategicMerge:
+  - |-
+    apiVersion: apps/v1
+    kind: Deployment
+    spec:
+      replicas: 3
+`,
+			wantErr: "finding target of inline patch: the patch has no name",
+		},
+		{
+			name: "missing patch file",
+			kustomization: `patchesStrategicMerge:
+  - missing.yaml
+`,
+			wantErr: "reading patch file: open",
+		},
+	}
+
+	for _, tt := range importTests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			kustomization := filepath.Join(dir, "kustomization.yaml")
+			assert.NoError(t, os.WriteFile(kustomization, []byte(tt.kustomization), 0o644))
+
+			_, err := ImportKustomization(kustomization, filepath.Join(dir, "migrations"))
+			assert.ErrorContains(t, err, tt.wantErr)
+		})
+	}
+}
+
+func TestImportKustomization_existing_migration(t *testing.T) {
+	src := copyManifests(t, "testdata/kustomize")
+	dir := filepath.Join(src, "migrations")
+	_, err := ImportKustomization(filepath.Join(src, "kustomization.yaml"), dir)
+	assert.NoError(t, err)
+
+	_, err = ImportKustomization(filepath.Join(src, "kustomization.yaml"), dir)
+	assert.ErrorContains(t, err, "migration replicas already exists in "+dir)
+
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 4)
+}
+
+func TestImportKustomization_after_existing_migrations(t *testing.T) {
+	src := copyManifests(t, "testdata/kustomize")
+	dir := filepath.Join(src, "migrations")
+	assert.NoError(t, os.MkdirAll(dir, 0o755))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "0001_existing.yaml"), []byte(`name: existing
+target:
+  version: v1
+  kind: ConfigMap
+up:
+  - type: application/merge-patch+json
+    change:
+      data:
+        testing: migrated
+`), 0o644))
+
+	filenames, err := ImportKustomization(filepath.Join(src, "kustomization.yaml"), dir)
+	assert.NoError(t, err)
+
+	assert.Equal(t, filepath.Join(dir, "0002_replicas.yaml"), filenames[0])
+	assert.NoError(t, ValidateDirectory(dir))
+	migrations, err := ParseDirectory(dir)
+	assert.NoError(t, err)
+	assert.Len(t, migrations, 5)
+}
+
+func TestImportKustomization_multiple_documents(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "kustomization.yaml"), []byte(`patchesStrategicMerge:
+  - deployments.yaml
+`), 0o644))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "deployments.yaml"), []byte(`apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: a
+spec:
+  replicas: 2
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: b
+spec:
+  replicas: 3
+`), 0o644))
+	migrationsDir := filepath.Join(dir, "migrations")
+
+	filenames, err := ImportKustomization(filepath.Join(dir, "kustomization.yaml"), migrationsDir)
+	assert.NoError(t, err)
+
+	want := []string{
+		filepath.Join(migrationsDir, "0001_deployments.yaml"),
+		filepath.Join(migrationsDir, "0002_deployments_2.yaml"),
+	}
+	if diff := cmp.Diff(want, filenames); diff != "" {
+		t.Fatalf("failed to import kustomization:\n%s", diff)
+	}
+	assert.Equal(t, `name: deployments-2
+target:
+  group: apps
+  kind: Deployment
+  name: b
+  version: v1
+up:
+- change:
+    apiVersion: apps/v1
+    kind: Deployment
+    metadata:
+      name: b
+    spec:
+      replicas: 3
+  type: application/strategic-merge-patch+json
+`, readFile(t, filenames[1]))
+	assert.NoError(t, ValidateDirectory(migrationsDir))
+}
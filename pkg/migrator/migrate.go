@@ -2,59 +2,674 @@ package migrator
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"time"
 
+	"github.com/bigkevmcd/migrator/pkg/api/v1alpha1"
+	"golang.org/x/sync/errgroup"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
+// errResourceChanged is returned when a resource has been changed between
+// reading and patching it.
+var errResourceChanged = errors.New("resource has changed since it was read")
+
 // MigrateUp executes the migrations forward.
-// TODO: option for batching!
-// TODO: option for dry-run (do not do the patch).
-func MigrateUp(ctx context.Context, kubeClient client.Client, migrations []Migration) error {
-	return migrate(ctx, kubeClient, migrations, func(m Migration) []Patch {
-		return m.Up
-	})
+func MigrateUp(ctx context.Context, kubeClient client.Client, migrations []Migration, opts ...Option) error {
+	o := newOptions(opts)
+	// The names and verifications are checked before any migration is
+	// applied, so that a migration cannot be applied and then fail to be
+	// recorded or rolled back.
+	for _, migration := range migrations {
+		if err := validateName(migration.Name); err != nil {
+			return err
+		}
+		if err := migration.Verify.validate(migration.Down); err != nil {
+			return fmt.Errorf("migration %s: %w", migration.Name, err)
+		}
+	}
+
+	applied, err := appliedMigrations(ctx, o.stateStore)
+	if err != nil {
+		return err
+	}
+
+	for _, migration := range migrations {
+		if _, ok := applied[migration.Name]; !ok {
+			if err := checkKeepGoing(o, migration, migration.Up); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, migration := range migrations {
+		checksum, err := migration.Checksum()
+		if err != nil {
+			return err
+		}
+
+		if record, ok := applied[migration.Name]; ok {
+			if record.Checksum != checksum {
+				return fmt.Errorf("migration %s has changed since it was applied", migration.Name)
+			}
+			continue
+		}
+
+		// The inverse patches are stored so that migrations without Down
+		// patches can be migrated down.
+		var inverses *inverseRecorder
+		if o.stateStore != nil && o.inverseStore != nil && o.persist() && len(migration.Down) == 0 {
+			inverses = newInverseRecorder(o.inverseStore, migration)
+		}
+
+		if err := migrate(ctx, kubeClient, o, migration, v1alpha1.DirectionUp, migration.Up, inverses); err != nil {
+			// The resources that were patched are restored by an atomic
+			// migration, otherwise they can still be migrated down.
+			if !o.atomic {
+				if flushErr := inverses.flush(ctx); flushErr != nil {
+					return errors.Join(err, flushErr)
+				}
+			}
+
+			return err
+		}
+
+		if err := inverses.flush(ctx); err != nil {
+			return err
+		}
+
+		if o.stateStore != nil && o.persist() {
+			if err := o.stateStore.Record(ctx, AppliedMigration{
+				Name:      migration.Name,
+				Checksum:  checksum,
+				AppliedAt: time.Now().UTC(),
+			}); err != nil {
+				return fmt.Errorf("recording migration %s: %w", migration.Name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// MigrateDown executes the migrations down, in the reverse order of the
+// migrations.
+//
+// When a StateStore is configured, only the applied migrations are executed,
+// and migrations without Down patches are reverted with the inverse patches
+// that were stored in the InversePatchStore when they were applied.
+func MigrateDown(ctx context.Context, kubeClient client.Client, migrations []Migration, opts ...Option) error {
+	o := newOptions(opts)
+	applied, err := appliedMigrations(ctx, o.stateStore)
+	if err != nil {
+		return err
+	}
+
+	toMigrate, err := migrationsToRollback(o, applied, migrations)
+	if err != nil {
+		return err
+	}
+
+	inverses := map[string][]InversePatch{}
+	for _, migration := range toMigrate {
+		patches := migration.Down
+		if len(patches) == 0 {
+			loaded, err := loadInversePatches(ctx, o, migration)
+			if err != nil {
+				return err
+			}
+			inverses[migration.Name] = loaded
+			patches = inversePatches(loaded)
+		}
+		if err := checkKeepGoing(o, migration, patches); err != nil {
+			return err
+		}
+	}
+
+	for _, migration := range toMigrate {
+		if inverses := inverses[migration.Name]; len(inverses) > 0 {
+			err = withHistory(ctx, kubeClient, o, migration, v1alpha1.DirectionDown, func(history *historyRecorder) error {
+				return revertResources(ctx, kubeClient, o, migration, inverses, history)
+			})
+		} else {
+			err = migrate(ctx, kubeClient, o, migration, v1alpha1.DirectionDown, migration.Down, nil)
+		}
+		if err != nil {
+			return err
+		}
+
+		if o.stateStore != nil && o.persist() {
+			if err := o.stateStore.Remove(ctx, migration.Name); err != nil {
+				return fmt.Errorf("removing record of migration %s: %w", migration.Name, err)
+			}
+		}
+
+		if o.snapshotStore != nil && o.persist() {
+			if err := o.snapshotStore.Delete(ctx, migration.Name); err != nil {
+				return err
+			}
+		}
+
+		if o.inverseStore != nil && o.persist() {
+			if err := o.inverseStore.Delete(ctx, migration.Name); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
 }
 
-// MigrateUp executes the migrations down.
-func MigrateDown(ctx context.Context, kubeClient client.Client, migrations []Migration) error {
-	return migrate(ctx, kubeClient, migrations, func(m Migration) []Patch {
-		return m.Down
+// checkKeepGoing returns an error if the migration is executed with
+// WithKeepGoing and the patches are not idempotent.
+//
+// A migration that fails for some resources is not recorded, so running it
+// again patches the resources that were migrated a second time.
+func checkKeepGoing(o *options, migration Migration, patches []Patch) error {
+	if !o.keepGoing || idempotentPatches(patches) {
+		return nil
+	}
+
+	return fmt.Errorf("migration %s cannot be executed with keep-going, its patches are not idempotent and would be applied twice to resources that were migrated if it is executed again", migration.Name)
+}
+
+func migrate(ctx context.Context, kubeClient client.Client, o *options, migration Migration, direction v1alpha1.Direction, patches []Patch, inverses *inverseRecorder) error {
+	return withHistory(ctx, kubeClient, o, migration, direction, func(history *historyRecorder) error {
+		return migrateResources(ctx, kubeClient, o, migration, direction, patches, history, inverses)
 	})
 }
 
-func migrate(ctx context.Context, kubeClient client.Client, migrations []Migration, f func(Migration) []Patch) error {
-	for _, migration := range migrations {
-		toMigrate, err := resourcesToMigrate(ctx, kubeClient, migration)
+// withHistory calls f with the recorder for the MigrationRecord of the
+// migration if migration records are enabled, and completes the record with
+// the result.
+func withHistory(ctx context.Context, kubeClient client.Client, o *options, migration Migration, direction v1alpha1.Direction, f func(*historyRecorder) error) error {
+	var history *historyRecorder
+	if o.migrationRecords && o.persist() {
+		var err error
+		history, err = startHistory(ctx, kubeClient, migration, direction)
 		if err != nil {
 			return err
 		}
+	}
+
+	migrationErr := f(history)
+	if err := history.complete(ctx, migrationErr); err != nil {
+		return errors.Join(migrationErr, err)
+	}
+
+	return migrationErr
+}
 
-		for _, resource := range toMigrate {
-			updated, err := ApplyPatches(&resource, f(migration))
+func migrateResources(ctx context.Context, kubeClient client.Client, o *options, migration Migration, direction v1alpha1.Direction, patches []Patch, history *historyRecorder, inverses *inverseRecorder) error {
+	var compensator *compensator
+	if o.atomic && o.persist() {
+		compensator = newCompensator()
+	}
+
+	verify := migration.Verify != nil && o.persist() && direction == v1alpha1.DirectionUp
+	snapshot := &snapshotter{store: o.snapshotStore, migration: migration}
+	if !o.persist() || direction != v1alpha1.DirectionUp {
+		snapshot.store = nil
+	}
+
+	// Each page of resources is patched as it is listed, only the identities
+	// of the migrated resources are kept for verification.
+	var (
+		failed   failures
+		migrated []unstructured.Unstructured
+		count    int
+	)
+	migrationErr := listResources(ctx, kubeClient, migration, int64(o.batchSize), func(page []unstructured.Unstructured, remaining int) error {
+		// The preconditions hold for the resources before they are migrated
+		// up, and may not once they have been.
+		if direction == v1alpha1.DirectionUp {
+			var err error
+			page, err = filterPreconditions(migration, page, func(resource *unstructured.Unstructured, reason string) error {
+				return reportSkipped(o.out, resource, reason)
+			})
 			if err != nil {
 				return err
 			}
+		}
+
+		if err := snapshot.save(ctx, page); err != nil {
+			return err
+		}
+
+		if err := migrateBatches(ctx, kubeClient, o, migration, page, patches, history, &failed, compensator, inverses); err != nil {
+			return err
+		}
 
-			if err := kubeClient.Patch(ctx, updated, client.MergeFrom(&resource)); err != nil {
-				// TODO
+		// The inverse patches of atomic migrations are only stored once all
+		// the resources are migrated.
+		if !o.atomic {
+			if err := inverses.flush(ctx); err != nil {
 				return err
 			}
 		}
+
+		if verify {
+			for i := range page {
+				migrated = append(migrated, identity(&page[i]))
+			}
+		}
+
+		count += len(page)
+		total := -1
+		if remaining >= 0 {
+			total = count + remaining
+		}
+
+		return o.reportProgress(migration, count, total)
+	})
+	if migrationErr == nil && len(failed.errs) > 0 {
+		migrationErr = failed.errs
+	}
+
+	if migrationErr == nil && verify {
+		migrationErr = verifyResources(ctx, kubeClient, migration, migrated)
+		if migrationErr != nil && migration.Verify.RollbackOnFailure {
+			if err := rollbackResources(ctx, kubeClient, o, migration, migrated); err != nil {
+				return errors.Join(migrationErr, err)
+			}
+
+			return migrationErr
+		}
+	}
+
+	if migrationErr != nil {
+		if err := compensator.restore(ctx, kubeClient, o.out); err != nil {
+			return errors.Join(migrationErr, fmt.Errorf("reverting migration %s: %w", migration.Name, err))
+		}
+	}
+
+	return migrationErr
+}
+
+// identity returns a copy of the resource with only the fields that identify
+// it.
+func identity(resource *unstructured.Unstructured) unstructured.Unstructured {
+	var u unstructured.Unstructured
+	u.SetGroupVersionKind(resource.GroupVersionKind())
+	u.SetNamespace(resource.GetNamespace())
+	u.SetName(resource.GetName())
+
+	return u
+}
+
+// rollbackResources applies the Down patches of the migration to the current
+// versions of the resources.
+func rollbackResources(ctx context.Context, kubeClient client.Client, o *options, migration Migration, resources []unstructured.Unstructured) error {
+	var current []unstructured.Unstructured
+	for _, resource := range resources {
+		u, err := refetchResource(ctx, kubeClient, &resource)
+		if err != nil {
+			return fmt.Errorf("rolling back migration %s: %w", migration.Name, err)
+		}
+		current = append(current, *u)
+	}
+
+	var failed failures
+	if err := migrateBatches(ctx, kubeClient, o, migration, current, migration.Down, nil, &failed, nil, nil); err != nil {
+		return fmt.Errorf("rolling back migration %s: %w", migration.Name, err)
+	}
+	if len(failed.errs) > 0 {
+		return fmt.Errorf("rolling back migration %s: %w", migration.Name, failed.errs)
 	}
 
 	return nil
 }
 
-func resourcesToMigrate(ctx context.Context, kubeClient client.Reader, migration Migration) ([]unstructured.Unstructured, error) {
+// migrateBatches patches the resources in batches of the configured size.
+func migrateBatches(ctx context.Context, kubeClient client.Client, o *options, migration Migration, toMigrate []unstructured.Unstructured, patches []Patch, history *historyRecorder, failed *failures, compensator *compensator, inverses *inverseRecorder) error {
+	batchSize := o.batchSize
+	if batchSize <= 0 {
+		batchSize = len(toMigrate)
+	}
+
+	for start := 0; start < len(toMigrate); start += batchSize {
+		batch := toMigrate[start:min(start+batchSize, len(toMigrate))]
+		if err := migrateBatch(ctx, kubeClient, o, migration, batch, patches, history, failed, compensator, inverses); err != nil {
+			return err
+		}
+
+		// The record is updated once for each batch rather than for each
+		// resource.
+		if err := history.flush(ctx); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// migrateBatch patches the resources in a batch, with up to the configured
+// concurrency.
+//
+// When keeping going, the resources that fail are added to failed rather than
+// stopping the migration, the original versions of the patched resources
+// are kept by the compensator, and the inverse patches by inverses.
+func migrateBatch(ctx context.Context, kubeClient client.Client, o *options, migration Migration, batch []unstructured.Unstructured, patches []Patch, history *historyRecorder, failed *failures, compensator *compensator, inverses *inverseRecorder) error {
+	g, ctx := errgroup.WithContext(ctx)
+	g.SetLimit(max(o.concurrency, 1))
+	for i := range batch {
+		g.Go(func() error {
+			// The context is cancelled when another resource fails.
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			if o.limiter != nil {
+				if err := o.limiter.Wait(ctx); err != nil {
+					return err
+				}
+			}
+
+			updated, original, err := patchResource(ctx, kubeClient, o, &batch[i], patches)
+			compensator.patched(original)
+			if err != nil {
+				resourceErr := &ResourceError{
+					Migration:        migration.Name,
+					GroupVersionKind: batch[i].GroupVersionKind(),
+					Key:              client.ObjectKeyFromObject(&batch[i]),
+					Err:              err,
+				}
+				if o.keepGoing {
+					failed.add(resourceErr)
+					return nil
+				}
+
+				return resourceErr
+			}
+
+			if err := inverses.migrated(original, updated); err != nil {
+				return err
+			}
+			history.migrated(updated)
+
+			return nil
+		})
+	}
+
+	return g.Wait()
+}
+
+// patchResource sends the patches for a resource.
+//
+// Server-side apply patches are sent individually, other patches are applied
+// locally and sent together as a merge patch.
+//
+// If the resource has changed since it was read, it is read again and the
+// patches are reapplied, up to the configured number of retries.
+//
+// The version of the resource before it was patched is returned, even if
+// sending the later patches fails, or nil if it was not patched.
+func patchResource(ctx context.Context, kubeClient client.Client, o *options, resource *unstructured.Unstructured, patches []Patch) (updated, original *unstructured.Unstructured, err error) {
+	current := resource
+	for _, batch := range batchPatches(patches) {
+		updated, err = patchBatch(ctx, kubeClient, o, current, batch)
+		for retries := 0; errors.Is(err, errResourceChanged); retries++ {
+			if retries >= o.conflictRetries {
+				return nil, original, fmt.Errorf("giving up after %d retries: %w", retries, err)
+			}
+
+			current, err = refetchResource(ctx, kubeClient, current)
+			if err != nil {
+				return nil, original, err
+			}
+			updated, err = patchBatch(ctx, kubeClient, o, current, batch)
+		}
+		if err != nil {
+			return nil, original, err
+		}
+
+		if original == nil {
+			original = current
+		}
+		current = updated
+	}
+
+	return current, original, nil
+}
+
+func patchBatch(ctx context.Context, kubeClient client.Client, o *options, current *unstructured.Unstructured, batch []Patch) (*unstructured.Unstructured, error) {
+	updated, err := ApplyPatches(current, batch, o.applyOpts...)
+	if err != nil {
+		return nil, err
+	}
+
+	// The reported patch does not include the resourceVersion for the
+	// optimistic lock.
+	toSend, patch, reported := updated, client.MergeFrom(current), client.MergeFrom(current)
+	if o.optimisticLock {
+		patch = client.MergeFromWithOptions(current, client.MergeFromWithOptimisticLock{})
+	}
+	patchOpts := []client.PatchOption{client.FieldOwner(o.fieldManager)}
+	if batch[0].Type == applyPatchType {
+		toSend, err = applyConfiguration(current, batch[0], o.applyOpts)
+		if err != nil {
+			return nil, err
+		}
+		patch, reported = client.Apply, client.Apply
+		if o.forceConflicts {
+			patchOpts = append(patchOpts, client.ForceOwnership)
+		}
+	}
+
+	if o.dryRun != DryRunNone {
+		if err := reportPatch(o.out, toSend, reported); err != nil {
+			return nil, err
+		}
+
+		if o.dryRun == DryRunClient {
+			return updated, nil
+		}
+		patchOpts = append(patchOpts, client.DryRunAll)
+	}
+
+	if err := kubeClient.Patch(ctx, toSend, patch, patchOpts...); err != nil {
+		if patch != client.Apply && apierrors.IsConflict(err) {
+			return nil, fmt.Errorf("%w: %w", errResourceChanged, err)
+		}
+
+		return nil, err
+	}
+
+	return toSend, nil
+}
+
+// refetchResource reads the current version of a resource.
+func refetchResource(ctx context.Context, kubeClient client.Reader, resource *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+	u := &unstructured.Unstructured{}
+	u.SetGroupVersionKind(resource.GroupVersionKind())
+	if err := kubeClient.Get(ctx, client.ObjectKeyFromObject(resource), u); err != nil {
+		return nil, fmt.Errorf("getting migration target %s %s: %w", resource.GetKind(), client.ObjectKeyFromObject(resource), err)
+	}
+
+	return u, nil
+}
+
+// batchPatches groups the patches that can be sent together, each server-side
+// apply patch is in a batch of its own.
+func batchPatches(patches []Patch) [][]Patch {
+	var (
+		batches [][]Patch
+		batch   []Patch
+	)
+	for _, patch := range patches {
+		if patch.Type != applyPatchType {
+			batch = append(batch, patch)
+			continue
+		}
+
+		if batch != nil {
+			batches = append(batches, batch)
+			batch = nil
+		}
+		batches = append(batches, []Patch{patch})
+	}
+
+	if batch != nil {
+		batches = append(batches, batch)
+	}
+
+	return batches
+}
+
+// applyConfiguration returns the object sent for a server-side apply patch,
+// the change with the identity of the resource.
+func applyConfiguration(resource *unstructured.Unstructured, p Patch, opts []ApplyOption) (*unstructured.Unstructured, error) {
+	if p.Template {
+		var err error
+		if p, err = renderPatch(p, resource, newApplyOptions(opts).vars); err != nil {
+			return nil, err
+		}
+	}
+
+	change, err := applyChange(p)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &unstructured.Unstructured{}
+	if err := json.Unmarshal(change, &cfg.Object); err != nil {
+		return nil, fmt.Errorf("decoding apply patch: %w", err)
+	}
+	if cfg.Object == nil {
+		cfg.Object = map[string]any{}
+	}
+	cfg.SetAPIVersion(resource.GetAPIVersion())
+	cfg.SetKind(resource.GetKind())
+	cfg.SetName(resource.GetName())
+	cfg.SetNamespace(resource.GetNamespace())
+
+	return cfg, nil
+}
+
+// migrationsToRollback returns the migrations to execute down, in the order
+// that they should be executed.
+//
+// If applied is not nil, only the applied migrations are returned.
+func migrationsToRollback(o *options, applied map[string]AppliedMigration, migrations []Migration) ([]Migration, error) {
+	var (
+		toMigrate []Migration
+		foundTo   bool
+	)
+	for i := len(migrations) - 1; i >= 0; i-- {
+		migration := migrations[i]
+		if applied != nil {
+			if _, ok := applied[migration.Name]; !ok {
+				continue
+			}
+		}
+
+		if o.downTo != "" && migration.Name == o.downTo {
+			foundTo = true
+			break
+		}
+
+		toMigrate = append(toMigrate, migration)
+	}
+
+	if o.downTo != "" && !foundTo {
+		return nil, fmt.Errorf("migration %s is not an applied migration", o.downTo)
+	}
+
+	if o.downSteps > 0 && len(toMigrate) > o.downSteps {
+		toMigrate = toMigrate[:o.downSteps]
+	}
+
+	return toMigrate, nil
+}
+
+// reportPatch writes the patch that would be sent for the resource.
+func reportPatch(w io.Writer, updated *unstructured.Unstructured, patch client.Patch) error {
+	data, err := patch.Data(updated)
+	if err != nil {
+		return fmt.Errorf("calculating patch for %s %s: %w", updated.GetKind(), client.ObjectKeyFromObject(updated), err)
+	}
+
+	if string(data) == "{}" {
+		_, err = fmt.Fprintf(w, "%s %s: unchanged\n", updated.GetKind(), client.ObjectKeyFromObject(updated))
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s %s: %s\n", updated.GetKind(), client.ObjectKeyFromObject(updated), data)
+
+	return err
+}
+
+// reportSkipped writes the reason that a resource is not migrated.
+func reportSkipped(w io.Writer, resource *unstructured.Unstructured, reason string) error {
+	_, err := fmt.Fprintf(w, "%s %s: skipped, %s\n", resource.GetKind(), client.ObjectKeyFromObject(resource), reason)
+
+	return err
+}
+
+func appliedMigrations(ctx context.Context, s StateStore) (map[string]AppliedMigration, error) {
+	if s == nil {
+		return nil, nil
+	}
+
+	records, err := s.Applied(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("loading applied migrations: %w", err)
+	}
+
+	applied := map[string]AppliedMigration{}
+	for _, record := range records {
+		applied[record.Name] = record
+	}
+
+	return applied, nil
+}
+
+// resourcesToMigrate returns the resources that match the migration target.
+//
+// If pageSize is greater than zero, resources are listed in pages of that
+// size.
+func resourcesToMigrate(ctx context.Context, kubeClient client.Reader, migration Migration, pageSize int64) ([]unstructured.Unstructured, error) {
+	var resources []unstructured.Unstructured
+	err := listResources(ctx, kubeClient, migration, pageSize, func(page []unstructured.Unstructured, _ int) error {
+		resources = append(resources, page...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return resources, nil
+}
+
+// listResources calls f with each page of the resources that match the
+// migration target as it is listed, and the number of resources that are
+// left to list, or -1 if that is not known.
+//
+// If pageSize is greater than zero, resources are listed in pages of that
+// size.
+func listResources(ctx context.Context, kubeClient client.Reader, migration Migration, pageSize int64, f func([]unstructured.Unstructured, int) error) error {
+	selector, err := migration.Target.selector()
+	if err != nil {
+		return err
+	}
+
 	target := migration.TargetObjectKey()
+	if target.Name != "" && isLiteralName(target.Name) && (target.Namespace == "" || isLiteralNamespace(target.Namespace)) {
+		resources, err := singleResource(ctx, kubeClient, target, migration)
+		if err != nil {
+			return err
+		}
 
-	if target.Name != "" {
-		return singleResource(ctx, kubeClient, target, migration)
+		return f(filterResources(resources, selector.matches), 0)
 	}
 
-	return multiResources(ctx, kubeClient, target, migration)
+	return multiResources(ctx, kubeClient, target, migration, selector, pageSize, func(page []unstructured.Unstructured, remaining int) error {
+		return f(filterResources(page, selector.matches), remaining)
+	})
 }
 
 func singleResource(ctx context.Context, kubeClient client.Reader, target client.ObjectKey, migration Migration) ([]unstructured.Unstructured, error) {
@@ -68,13 +683,52 @@ func singleResource(ctx context.Context, kubeClient client.Reader, target client
 	return []unstructured.Unstructured{u}, nil
 }
 
-func multiResources(ctx context.Context, kubeClient client.Reader, target client.ObjectKey, migration Migration) ([]unstructured.Unstructured, error) {
-	ul := unstructured.UnstructuredList{}
-	ul.SetGroupVersionKind(migration.TargetGroupVersionKind())
+func multiResources(ctx context.Context, kubeClient client.Reader, target client.ObjectKey, migration Migration, selector *targetSelector, pageSize int64, f func([]unstructured.Unstructured, int) error) error {
+	var listOpts []client.ListOption
+	if target.Namespace != "" && isLiteralNamespace(target.Namespace) {
+		listOpts = append(listOpts, client.InNamespace(target.Namespace))
+	}
+	if selector.labels != nil {
+		listOpts = append(listOpts, client.MatchingLabelsSelector{Selector: selector.labels})
+	}
+	if pageSize > 0 {
+		listOpts = append(listOpts, client.Limit(pageSize))
+	}
+
+	for continueToken := ""; ; {
+		ul := unstructured.UnstructuredList{}
+		ul.SetGroupVersionKind(migration.TargetGroupVersionKind())
+
+		if err := kubeClient.List(ctx, &ul, append(listOpts, client.Continue(continueToken))...); err != nil {
+			return fmt.Errorf("getting migration targets %s %s: %w", ul.GetKind(), target, err)
+		}
+
+		continueToken = ul.GetContinue()
+		remaining := -1
+		switch {
+		case continueToken == "":
+			remaining = 0
+		case ul.GetRemainingItemCount() != nil:
+			remaining = int(*ul.GetRemainingItemCount())
+		}
 
-	if err := kubeClient.List(ctx, &ul); err != nil {
-		return nil, fmt.Errorf("getting migration targets %s %s: %w", ul.GetKind(), target, err)
+		if err := f(ul.Items, remaining); err != nil {
+			return err
+		}
+
+		if continueToken == "" {
+			return nil
+		}
+	}
+}
+
+func filterResources(resources []unstructured.Unstructured, pred func(*unstructured.Unstructured) bool) []unstructured.Unstructured {
+	var filtered []unstructured.Unstructured
+	for _, resource := range resources {
+		if pred(&resource) {
+			filtered = append(filtered, resource)
+		}
 	}
 
-	return ul.Items, nil
+	return filtered
 }
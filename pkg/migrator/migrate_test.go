@@ -1,16 +1,24 @@
 package migrator
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
 	"github.com/stretchr/testify/assert"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	apitypes "k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/intstr"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
 	"sigs.k8s.io/kustomize/v3/pkg/gvk"
 	"sigs.k8s.io/kustomize/v3/pkg/types"
 )
@@ -28,14 +36,16 @@ func TestMigrateUp(t *testing.T) {
 				{
 					Name:     "patch-service",
 					Filename: "testdata/simple.yaml",
-					Target: types.PatchTarget{
-						Gvk: gvk.Gvk{
-							Group:   "",
-							Version: "v1",
-							Kind:    "Service",
+					Target: Target{
+						PatchTarget: types.PatchTarget{
+							Gvk: gvk.Gvk{
+								Group:   "",
+								Version: "v1",
+								Kind:    "Service",
+							},
+							Namespace: "default",
+							Name:      "test-svc",
 						},
-						Namespace: "default",
-						Name:      "test-svc",
 					},
 					Up: []Patch{
 						{
@@ -61,14 +71,16 @@ func TestMigrateUp(t *testing.T) {
 				{
 					Name:     "patch-service",
 					Filename: "testdata/simple.yaml",
-					Target: types.PatchTarget{
-						Gvk: gvk.Gvk{
-							Group:   "",
-							Version: "v1",
-							Kind:    "Service",
+					Target: Target{
+						PatchTarget: types.PatchTarget{
+							Gvk: gvk.Gvk{
+								Group:   "",
+								Version: "v1",
+								Kind:    "Service",
+							},
+							Namespace: "default",
+							Name:      "test-svc",
 						},
-						Namespace: "default",
-						Name:      "test-svc",
 					},
 					Up: []Patch{
 						{
@@ -115,14 +127,16 @@ func TestMigrateUp_missing_resource(t *testing.T) {
 		{
 			Name:     "patch-service",
 			Filename: "testdata/simple.yaml",
-			Target: types.PatchTarget{
-				Gvk: gvk.Gvk{
-					Group:   "",
-					Version: "v1",
-					Kind:    "Service",
+			Target: Target{
+				PatchTarget: types.PatchTarget{
+					Gvk: gvk.Gvk{
+						Group:   "",
+						Version: "v1",
+						Kind:    "Service",
+					},
+					Namespace: "default",
+					Name:      "testing",
 				},
-				Namespace: "default",
-				Name:      "testing",
 			},
 			Up: []Patch{
 				{
@@ -144,14 +158,16 @@ func TestMigrateUp_bad_resource(t *testing.T) {
 		{
 			Name:     "patch-service",
 			Filename: "testdata/simple.yaml",
-			Target: types.PatchTarget{
-				Gvk: gvk.Gvk{
-					Group:   "",
-					Version: "v1",
-					Kind:    "Service",
+			Target: Target{
+				PatchTarget: types.PatchTarget{
+					Gvk: gvk.Gvk{
+						Group:   "",
+						Version: "v1",
+						Kind:    "Service",
+					},
+					Namespace: "default",
+					Name:      "test-svc",
 				},
-				Namespace: "default",
-				Name:      "test-svc",
 			},
 			Up: []Patch{
 				{
@@ -173,14 +189,16 @@ func TestMigrateDown(t *testing.T) {
 		{
 			Name:     "patch-service",
 			Filename: "testdata/simple.yaml",
-			Target: types.PatchTarget{
-				Gvk: gvk.Gvk{
-					Group:   "",
-					Version: "v1",
-					Kind:    "Service",
+			Target: Target{
+				PatchTarget: types.PatchTarget{
+					Gvk: gvk.Gvk{
+						Group:   "",
+						Version: "v1",
+						Kind:    "Service",
+					},
+					Namespace: "default",
+					Name:      "test-svc",
 				},
-				Namespace: "default",
-				Name:      "test-svc",
 			},
 			Up: []Patch{
 				{
@@ -230,13 +248,15 @@ func TestMigrateUp_multiple_resources(t *testing.T) {
 		{
 			Name:     "patch-service",
 			Filename: "testdata/simple.yaml",
-			Target: types.PatchTarget{
-				Gvk: gvk.Gvk{
-					Group:   "",
-					Version: "v1",
-					Kind:    "Service",
+			Target: Target{
+				PatchTarget: types.PatchTarget{
+					Gvk: gvk.Gvk{
+						Group:   "",
+						Version: "v1",
+						Kind:    "Service",
+					},
+					Namespace: "default",
 				},
-				Namespace: "default",
 			},
 			Up: []Patch{
 				{
@@ -331,3 +351,1144 @@ func collect[T any, R any](input []T, pred func(T) R) []R {
 
 	return result
 }
+
+func TestMigrateUp_with_state_store(t *testing.T) {
+	migrations := []Migration{
+		{
+			Name:     "add-port",
+			Filename: "testdata/simple.yaml",
+			Target: Target{
+				PatchTarget: types.PatchTarget{
+					Gvk: gvk.Gvk{
+						Group:   "",
+						Version: "v1",
+						Kind:    "Service",
+					},
+					Namespace: "default",
+					Name:      "test-svc",
+				},
+			},
+			Up: []Patch{
+				{
+					Type:   "application/json-patch+json",
+					Change: `[{"op":"add","path":"/spec/ports/-","value":{"name":"https","port":443,"protocol":"TCP"}}]`,
+				},
+			},
+		},
+	}
+
+	fc := fake.NewClientBuilder().WithObjects(newService()).Build()
+	store := NewConfigMapStateStore(fc, client.ObjectKey{Name: "migrator-state", Namespace: "default"})
+	inverseStore := NewSecretInversePatchStore(fc, "default")
+
+	// The second run should be skipped because the migration has been applied.
+	for i := 0; i < 2; i++ {
+		if err := MigrateUp(context.TODO(), fc, migrations, WithStateStore(store), WithInversePatchStore(inverseStore)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var svc corev1.Service
+	if err := fc.Get(context.TODO(), client.ObjectKey{Name: "test-svc", Namespace: "default"}, &svc); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []corev1.ServicePort{
+		{
+			Protocol:   "TCP",
+			Name:       "http-80",
+			Port:       80,
+			TargetPort: intstr.FromInt(9376),
+		},
+		{
+			Protocol: "TCP",
+			Name:     "https",
+			Port:     443,
+		},
+	}
+	if diff := cmp.Diff(want, svc.Spec.Ports); diff != "" {
+		t.Errorf("failed to migrate:\n%s", diff)
+	}
+
+	applied, err := store.Applied(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	checksum, err := migrations[0].Checksum()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantApplied := []AppliedMigration{
+		{
+			Name:     "add-port",
+			Checksum: checksum,
+		},
+	}
+	if diff := cmp.Diff(wantApplied, applied, cmpopts.IgnoreFields(AppliedMigration{}, "AppliedAt")); diff != "" {
+		t.Errorf("failed to record migration:\n%s", diff)
+	}
+
+	inverses, err := inverseStore.Load(context.TODO(), "add-port")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantInverses := []InversePatch{
+		{
+			APIVersion: "v1",
+			Kind:       "Service",
+			Namespace:  "default",
+			Name:       "test-svc",
+			Patch:      json.RawMessage(`[{"op":"remove","path":"/spec/ports/1"}]`),
+		},
+	}
+	if diff := cmp.Diff(wantInverses, inverses); diff != "" {
+		t.Errorf("failed to store inverse patches:\n%s", diff)
+	}
+}
+
+func TestMigrateUp_with_state_store_changed_migration(t *testing.T) {
+	migrations := []Migration{
+		{
+			Name:     "patch-service",
+			Filename: "testdata/simple.yaml",
+			Target: Target{
+				PatchTarget: types.PatchTarget{
+					Gvk: gvk.Gvk{
+						Group:   "",
+						Version: "v1",
+						Kind:    "Service",
+					},
+					Namespace: "default",
+					Name:      "test-svc",
+				},
+			},
+			Up: []Patch{
+				{
+					Type:   "application/json-patch+json",
+					Change: `[{"op":"replace","path":"/spec/ports/0/port","value":81}]`,
+				},
+			},
+		},
+	}
+
+	fc := fake.NewClientBuilder().WithObjects(newService()).Build()
+	store := NewConfigMapStateStore(fc, client.ObjectKey{Name: "migrator-state", Namespace: "default"})
+	if err := MigrateUp(context.TODO(), fc, migrations, WithStateStore(store)); err != nil {
+		t.Fatal(err)
+	}
+
+	migrations[0].Up[0].Change = `[{"op":"replace","path":"/spec/ports/0/port","value":82}]`
+	err := MigrateUp(context.TODO(), fc, migrations, WithStateStore(store))
+	assert.ErrorContains(t, err, "migration patch-service has changed since it was applied")
+}
+
+func TestMigrateUp_invalid_migration_name(t *testing.T) {
+	nameTests := []struct {
+		name    string
+		wantErr string
+	}{
+		{name: "add item", wantErr: `invalid migration name "add item"`},
+		{name: "", wantErr: "migration has no name"},
+	}
+
+	for _, tt := range nameTests {
+		t.Run(tt.name, func(t *testing.T) {
+			migrations := []Migration{
+				{
+					Name: "add-port",
+					Target: Target{
+						PatchTarget: types.PatchTarget{
+							Gvk:       gvk.Gvk{Version: "v1", Kind: "Service"},
+							Namespace: "default",
+							Name:      "test-svc",
+						},
+					},
+					Up: []Patch{
+						{
+							Type:   "application/json-patch+json",
+							Change: `[{"op":"replace","path":"/spec/ports/0/port","value":81}]`,
+						},
+					},
+				},
+				{
+					Name: tt.name,
+					Target: Target{
+						PatchTarget: types.PatchTarget{
+							Gvk:       gvk.Gvk{Version: "v1", Kind: "Service"},
+							Namespace: "default",
+							Name:      "test-svc",
+						},
+					},
+					Up: []Patch{
+						{
+							Type:   "application/json-patch+json",
+							Change: `[{"op":"replace","path":"/spec/ports/0/port","value":82}]`,
+						},
+					},
+				},
+			}
+
+			fc := fake.NewClientBuilder().WithObjects(newService()).Build()
+			store := NewConfigMapStateStore(fc, client.ObjectKey{Name: "migrator-state", Namespace: "default"})
+			err := MigrateUp(context.TODO(), fc, migrations, WithStateStore(store))
+			assert.ErrorContains(t, err, tt.wantErr)
+
+			// No migration is applied.
+			var svc corev1.Service
+			if err := fc.Get(context.TODO(), client.ObjectKey{Name: "test-svc", Namespace: "default"}, &svc); err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, int32(80), svc.Spec.Ports[0].Port)
+		})
+	}
+}
+
+func TestMigrateDown_with_state_store(t *testing.T) {
+	migrations := []Migration{
+		{
+			Name:     "patch-service",
+			Filename: "testdata/simple.yaml",
+			Target: Target{
+				PatchTarget: types.PatchTarget{
+					Gvk: gvk.Gvk{
+						Group:   "",
+						Version: "v1",
+						Kind:    "Service",
+					},
+					Namespace: "default",
+					Name:      "test-svc",
+				},
+			},
+			Up: []Patch{
+				{
+					Type:   "application/json-patch+json",
+					Change: `[{"op":"replace","path":"/spec/ports/0/port","value":81}]`,
+				},
+			},
+			Down: []Patch{
+				{
+					Type:   "application/json-patch+json",
+					Change: `[{"op":"replace","path":"/spec/ports/0/port","value":80}]`,
+				},
+			},
+		},
+	}
+
+	fc := fake.NewClientBuilder().WithObjects(newService()).Build()
+	store := NewConfigMapStateStore(fc, client.ObjectKey{Name: "migrator-state", Namespace: "default"})
+	if err := MigrateUp(context.TODO(), fc, migrations, WithStateStore(store)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := MigrateDown(context.TODO(), fc, migrations, WithStateStore(store)); err != nil {
+		t.Fatal(err)
+	}
+
+	applied, err := store.Applied(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, applied)
+}
+
+func TestMigrateUp_dry_run(t *testing.T) {
+	migrations := []Migration{
+		{
+			Name:     "patch-service",
+			Filename: "testdata/simple.yaml",
+			Target: Target{
+				PatchTarget: types.PatchTarget{
+					Gvk: gvk.Gvk{
+						Group:   "",
+						Version: "v1",
+						Kind:    "Service",
+					},
+					Namespace: "default",
+					Name:      "test-svc",
+				},
+			},
+			Up: []Patch{
+				{
+					Type:   "application/json-patch+json",
+					Change: `[{"op":"replace","path":"/spec/ports/0/port","value":81}]`,
+				},
+			},
+		},
+	}
+
+	for _, dryRun := range []DryRun{DryRunClient, DryRunServer} {
+		t.Run(string(dryRun), func(t *testing.T) {
+			fc := fake.NewClientBuilder().WithObjects(newService()).Build()
+			store := NewConfigMapStateStore(fc, client.ObjectKey{Name: "migrator-state", Namespace: "default"})
+			var out bytes.Buffer
+
+			if err := MigrateUp(context.TODO(), fc, migrations, WithDryRun(dryRun), WithOutput(&out), WithStateStore(store)); err != nil {
+				t.Fatal(err)
+			}
+
+			var svc corev1.Service
+			if err := fc.Get(context.TODO(), client.ObjectKey{Name: "test-svc", Namespace: "default"}, &svc); err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(newService().Spec.Ports, svc.Spec.Ports); diff != "" {
+				t.Errorf("dry-run changed the resource:\n%s", diff)
+			}
+
+			want := `Service default/test-svc: {"spec":{"ports":[{"name":"http-80","port":81,"protocol":"TCP","targetPort":9376}]}}` + "\n"
+			if diff := cmp.Diff(want, out.String()); diff != "" {
+				t.Errorf("failed to report patch:\n%s", diff)
+			}
+
+			applied, err := store.Applied(context.TODO())
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Empty(t, applied)
+		})
+	}
+}
+
+func TestResourcesToMigrate(t *testing.T) {
+	serviceTarget := func(opts ...func(*Target)) Target {
+		target := Target{
+			PatchTarget: types.PatchTarget{
+				Gvk: gvk.Gvk{
+					Group:   "",
+					Version: "v1",
+					Kind:    "Service",
+				},
+			},
+		}
+		for _, opt := range opts {
+			opt(&target)
+		}
+
+		return target
+	}
+
+	resourceTests := []struct {
+		name   string
+		target Target
+		want   []string
+	}{
+		{
+			name:   "all namespaces",
+			target: serviceTarget(),
+			want:   []string{"default/svc-1", "default/svc-2", "staging/svc-3"},
+		},
+		{
+			name: "namespace",
+			target: serviceTarget(func(t *Target) {
+				t.Namespace = "staging"
+			}),
+			want: []string{"staging/svc-3"},
+		},
+		{
+			name: "label selector",
+			target: serviceTarget(func(t *Target) {
+				t.LabelSelector = "app=frontend"
+			}),
+			want: []string{"default/svc-1", "staging/svc-3"},
+		},
+		{
+			name: "label selector and namespace",
+			target: serviceTarget(func(t *Target) {
+				t.Namespace = "default"
+				t.LabelSelector = "app in (frontend, backend)"
+			}),
+			want: []string{"default/svc-1", "default/svc-2"},
+		},
+		{
+			name: "annotation selector",
+			target: serviceTarget(func(t *Target) {
+				t.AnnotationSelector = "example.com/migrate"
+			}),
+			want: []string{"default/svc-2"},
+		},
+		{
+			name: "name regexp",
+			target: serviceTarget(func(t *Target) {
+				t.Name = "svc-[23]"
+			}),
+			want: []string{"default/svc-2", "staging/svc-3"},
+		},
+		{
+			name: "name regexp matches the whole name",
+			target: serviceTarget(func(t *Target) {
+				t.Name = "vc-.*"
+			}),
+			want: []string{},
+		},
+		{
+			name: "namespace regexp",
+			target: serviceTarget(func(t *Target) {
+				t.Namespace = "stag.*"
+			}),
+			want: []string{"staging/svc-3"},
+		},
+		{
+			name: "name and namespace regexps",
+			target: serviceTarget(func(t *Target) {
+				t.Name = "svc-.*"
+				t.Namespace = "default|staging"
+				t.LabelSelector = "app=frontend"
+			}),
+			want: []string{"default/svc-1", "staging/svc-3"},
+		},
+		{
+			name: "name with annotation selector",
+			target: serviceTarget(func(t *Target) {
+				t.Namespace = "default"
+				t.Name = "svc-1"
+				t.AnnotationSelector = "example.com/migrate"
+			}),
+			want: []string{},
+		},
+	}
+
+	fc := fake.NewClientBuilder().WithObjects(
+		createService(withName("svc-1"), withLabels(map[string]string{"app": "frontend"})),
+		createService(withName("svc-2"), withLabels(map[string]string{"app": "backend"}),
+			withAnnotations(map[string]string{"example.com/migrate": "true"})),
+		createService(withName("svc-3"), withNamespace("staging"), withLabels(map[string]string{"app": "frontend"})),
+	).Build()
+
+	for _, tt := range resourceTests {
+		t.Run(tt.name, func(t *testing.T) {
+			resources, err := resourcesToMigrate(context.TODO(), fc, Migration{Name: "test", Target: tt.target}, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			names := collect(resources, func(u unstructured.Unstructured) string {
+				return client.ObjectKeyFromObject(&u).String()
+			})
+			if diff := cmp.Diff(tt.want, names); diff != "" {
+				t.Errorf("failed to find resources:\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestResourcesToMigrate_invalid_selectors(t *testing.T) {
+	selectorTests := []struct {
+		name    string
+		target  Target
+		wantErr string
+	}{
+		{
+			name:    "label selector",
+			target:  Target{LabelSelector: "app in ("},
+			wantErr: `parsing label selector "app in ("`,
+		},
+		{
+			name:    "annotation selector",
+			target:  Target{AnnotationSelector: "!!"},
+			wantErr: `parsing annotation selector "!!"`,
+		},
+		{
+			name:    "name",
+			target:  Target{PatchTarget: types.PatchTarget{Name: "svc-("}},
+			wantErr: `parsing name "svc-("`,
+		},
+		{
+			name:    "namespace",
+			target:  Target{PatchTarget: types.PatchTarget{Namespace: "team-["}},
+			wantErr: `parsing namespace "team-["`,
+		},
+	}
+
+	for _, tt := range selectorTests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := resourcesToMigrate(context.TODO(), newFakeClient(), Migration{Name: "test", Target: tt.target}, 0)
+			assert.ErrorContains(t, err, tt.wantErr)
+		})
+	}
+}
+
+func withNamespace(s string) func(*corev1.Service) {
+	return func(svc *corev1.Service) {
+		svc.SetNamespace(s)
+	}
+}
+
+func withLabels(l map[string]string) func(*corev1.Service) {
+	return func(svc *corev1.Service) {
+		svc.SetLabels(l)
+	}
+}
+
+func withAnnotations(a map[string]string) func(*corev1.Service) {
+	return func(svc *corev1.Service) {
+		svc.SetAnnotations(a)
+	}
+}
+
+func TestMigrateDown_reverse_order(t *testing.T) {
+	migrations := stepMigrations(3)
+	fc := fake.NewClientBuilder().WithObjects(newConfigMap()).Build()
+
+	if err := MigrateUp(context.TODO(), fc, migrations); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "3", configMapData(t, fc)["step"])
+
+	// The down patches test the current step and so fail if the migrations are
+	// executed in the wrong order.
+	if err := MigrateDown(context.TODO(), fc, migrations); err != nil {
+		t.Fatal(err)
+	}
+	assert.NotContains(t, configMapData(t, fc), "step")
+}
+
+func TestMigrateDown_applied_migrations(t *testing.T) {
+	downTests := []struct {
+		name        string
+		opts        []Option
+		wantStep    string
+		wantApplied []string
+	}{
+		{
+			name:        "all applied migrations",
+			wantStep:    "",
+			wantApplied: []string{},
+		},
+		{
+			name:        "steps",
+			opts:        []Option{WithDownSteps(1)},
+			wantStep:    "1",
+			wantApplied: []string{"step-0"},
+		},
+		{
+			name:        "to migration",
+			opts:        []Option{WithDownTo("step-0")},
+			wantStep:    "1",
+			wantApplied: []string{"step-0"},
+		},
+	}
+
+	for _, tt := range downTests {
+		t.Run(tt.name, func(t *testing.T) {
+			migrations := stepMigrations(3)
+			fc := fake.NewClientBuilder().WithObjects(newConfigMap()).Build()
+			store := NewConfigMapStateStore(fc, client.ObjectKey{Name: "migrator-state", Namespace: "default"})
+
+			// Only the first two migrations are applied, the down patches of the
+			// third would fail.
+			if err := MigrateUp(context.TODO(), fc, migrations[:2], WithStateStore(store)); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := MigrateDown(context.TODO(), fc, migrations, append(tt.opts, WithStateStore(store))...); err != nil {
+				t.Fatal(err)
+			}
+
+			assert.Equal(t, tt.wantStep, configMapData(t, fc)["step"])
+			applied, err := store.Applied(context.TODO())
+			if err != nil {
+				t.Fatal(err)
+			}
+			names := collect(applied, func(a AppliedMigration) string {
+				return a.Name
+			})
+			if diff := cmp.Diff(tt.wantApplied, names); diff != "" {
+				t.Errorf("failed to migrate down:\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestMigrateDown_to_unapplied_migration(t *testing.T) {
+	migrations := stepMigrations(3)
+	fc := fake.NewClientBuilder().WithObjects(newConfigMap()).Build()
+	store := NewConfigMapStateStore(fc, client.ObjectKey{Name: "migrator-state", Namespace: "default"})
+	if err := MigrateUp(context.TODO(), fc, migrations[:2], WithStateStore(store)); err != nil {
+		t.Fatal(err)
+	}
+
+	err := MigrateDown(context.TODO(), fc, migrations, WithStateStore(store), WithDownTo("step-2"))
+	assert.ErrorContains(t, err, "migration step-2 is not an applied migration")
+}
+
+// stepMigrations creates migrations that each depend on the previous migration
+// having been applied.
+func stepMigrations(n int) []Migration {
+	var migrations []Migration
+	for i := 0; i < n; i++ {
+		migration := Migration{
+			Name: fmt.Sprintf("step-%d", i),
+			Target: Target{
+				PatchTarget: types.PatchTarget{
+					Gvk: gvk.Gvk{
+						Version: "v1",
+						Kind:    "ConfigMap",
+					},
+					Namespace: "default",
+					Name:      "test-cm",
+				},
+			},
+			Up: []Patch{
+				{
+					Type:   "application/json-patch+json",
+					Change: fmt.Sprintf(`[{"op":"add","path":"/data/step","value":"%d"}]`, i+1),
+				},
+			},
+			Down: []Patch{
+				{
+					Type:   "application/json-patch+json",
+					Change: fmt.Sprintf(`[{"op":"test","path":"/data/step","value":"%d"},{"op":"replace","path":"/data/step","value":"%d"}]`, i+1, i),
+				},
+			},
+		}
+		if i > 0 {
+			migration.Up[0].Change = fmt.Sprintf(`[{"op":"test","path":"/data/step","value":"%d"},{"op":"replace","path":"/data/step","value":"%d"}]`, i, i+1)
+		} else {
+			migration.Down[0].Change = `[{"op":"test","path":"/data/step","value":"1"},{"op":"remove","path":"/data/step"}]`
+		}
+		migrations = append(migrations, migration)
+	}
+
+	return migrations
+}
+
+func configMapData(t *testing.T, kubeClient client.Client) map[string]string {
+	t.Helper()
+	var cm corev1.ConfigMap
+	if err := kubeClient.Get(context.TODO(), client.ObjectKey{Name: "test-cm", Namespace: "default"}, &cm); err != nil {
+		t.Fatal(err)
+	}
+
+	return cm.Data
+}
+
+func TestMigrateUp_apply_patch(t *testing.T) {
+	applyMigrations := func(applyPatch Patch) []Migration {
+		return []Migration{
+			{
+				Name: "apply-service",
+				Target: Target{
+					PatchTarget: types.PatchTarget{
+						Gvk: gvk.Gvk{
+							Group:   "",
+							Version: "v1",
+							Kind:    "Service",
+						},
+						Namespace: "default",
+						Name:      "test-svc",
+					},
+				},
+				Up: []Patch{
+					{
+						Type:   "application/merge-patch+json",
+						Change: `{"metadata":{"labels":{"migrated":"true"}}}`,
+					},
+					applyPatch,
+				},
+			},
+		}
+	}
+	nodePort := Patch{
+		Type:   "application/apply-patch+yaml",
+		Change: "spec:\n  type: NodePort\n",
+	}
+
+	applyTests := []struct {
+		name        string
+		applyPatch  Patch
+		opts        []Option
+		wantApplied string
+		wantOwner   string
+		wantForce   *bool
+	}{
+		{
+			name:        "default field manager",
+			applyPatch:  nodePort,
+			wantApplied: `{"apiVersion":"v1","kind":"Service","metadata":{"name":"test-svc","namespace":"default"},"spec":{"type":"NodePort"}}`,
+			wantOwner:   "migrator",
+		},
+		{
+			name:        "configured field manager",
+			applyPatch:  nodePort,
+			opts:        []Option{WithFieldManager("platform-team"), WithForceConflicts()},
+			wantApplied: `{"apiVersion":"v1","kind":"Service","metadata":{"name":"test-svc","namespace":"default"},"spec":{"type":"NodePort"}}`,
+			wantOwner:   "platform-team",
+			wantForce:   ptr(true),
+		},
+		{
+			name: "template",
+			applyPatch: Patch{
+				Type:     "application/apply-patch+yaml",
+				Template: true,
+				Change:   "metadata:\n  annotations:\n    owner: \"{{ .Name }}-{{ .Vars.team }}\"\n",
+			},
+			opts:        []Option{WithApplyOptions(WithVariables(map[string]string{"team": "platform"}))},
+			wantApplied: `{"apiVersion":"v1","kind":"Service","metadata":{"annotations":{"owner":"test-svc-platform"},"name":"test-svc","namespace":"default"}}`,
+			wantOwner:   "migrator",
+		},
+	}
+
+	for _, tt := range applyTests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				applied   []byte
+				applyOpts client.PatchOptions
+			)
+			fc := fake.NewClientBuilder().WithObjects(newService()).WithInterceptorFuncs(interceptor.Funcs{
+				Patch: func(ctx context.Context, c client.WithWatch, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+					if patch.Type() != apitypes.ApplyPatchType {
+						return c.Patch(ctx, obj, patch, opts...)
+					}
+
+					var err error
+					applied, err = patch.Data(obj)
+					applyOpts.ApplyOptions(opts)
+
+					return err
+				},
+			}).Build()
+
+			if err := MigrateUp(context.TODO(), fc, applyMigrations(tt.applyPatch), tt.opts...); err != nil {
+				t.Fatal(err)
+			}
+
+			var svc corev1.Service
+			if err := fc.Get(context.TODO(), client.ObjectKey{Name: "test-svc", Namespace: "default"}, &svc); err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, map[string]string{"migrated": "true"}, svc.GetLabels())
+
+			assert.JSONEq(t, tt.wantApplied, string(applied))
+			assert.Equal(t, tt.wantOwner, applyOpts.FieldManager)
+			assert.Equal(t, tt.wantForce, applyOpts.Force)
+		})
+	}
+}
+
+func TestMigrateUp_apply_patch_dry_run(t *testing.T) {
+	migrations := []Migration{
+		{
+			Name: "apply-service",
+			Target: Target{
+				PatchTarget: types.PatchTarget{
+					Gvk: gvk.Gvk{
+						Group:   "",
+						Version: "v1",
+						Kind:    "Service",
+					},
+					Namespace: "default",
+					Name:      "test-svc",
+				},
+			},
+			Up: []Patch{
+				{
+					Type:  "application/apply-patch+yaml",
+					Merge: map[string]any{"spec": map[string]any{"type": "NodePort"}},
+				},
+			},
+		},
+	}
+	fc := fake.NewClientBuilder().WithObjects(newService()).Build()
+	var out bytes.Buffer
+
+	if err := MigrateUp(context.TODO(), fc, migrations, WithDryRun(DryRunClient), WithOutput(&out)); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `Service default/test-svc: {"apiVersion":"v1","kind":"Service","metadata":{"name":"test-svc","namespace":"default"},"spec":{"type":"NodePort"}}` + "\n"
+	if diff := cmp.Diff(want, out.String()); diff != "" {
+		t.Errorf("failed to report patch:\n%s", diff)
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func TestMigrateUp_resource_changed(t *testing.T) {
+	migrations := []Migration{
+		{
+			Name: "patch-service",
+			Target: Target{
+				PatchTarget: types.PatchTarget{
+					Gvk: gvk.Gvk{
+						Group:   "",
+						Version: "v1",
+						Kind:    "Service",
+					},
+					Namespace: "default",
+					Name:      "test-svc",
+				},
+			},
+			Up: []Patch{
+				{
+					Type:   "application/json-patch+json",
+					Change: `[{"op":"replace","path":"/spec/ports/0/port","value":81}]`,
+				},
+			},
+		},
+	}
+
+	// changeService updates the service before the first n patches, as a
+	// controller would.
+	changeService := func(n int, patches *int) interceptor.Funcs {
+		return interceptor.Funcs{
+			Patch: func(ctx context.Context, c client.WithWatch, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+				*patches++
+				if *patches <= n {
+					var svc corev1.Service
+					if err := c.Get(ctx, client.ObjectKeyFromObject(obj), &svc); err != nil {
+						return err
+					}
+					svc.SetLabels(map[string]string{"controller": fmt.Sprintf("update-%d", *patches)})
+					if err := c.Update(ctx, &svc); err != nil {
+						return err
+					}
+				}
+
+				return c.Patch(ctx, obj, patch, opts...)
+			},
+		}
+	}
+
+	t.Run("retrying the patch", func(t *testing.T) {
+		var patches int
+		fc := fake.NewClientBuilder().WithObjects(newService()).WithInterceptorFuncs(changeService(2, &patches)).Build()
+
+		if err := MigrateUp(context.TODO(), fc, migrations); err != nil {
+			t.Fatal(err)
+		}
+
+		var svc corev1.Service
+		if err := fc.Get(context.TODO(), client.ObjectKey{Name: "test-svc", Namespace: "default"}, &svc); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, 3, patches)
+		assert.Equal(t, int32(81), svc.Spec.Ports[0].Port)
+		assert.Equal(t, map[string]string{"controller": "update-2"}, svc.GetLabels())
+	})
+
+	t.Run("exhausting the retries", func(t *testing.T) {
+		var patches int
+		fc := fake.NewClientBuilder().WithObjects(newService()).WithInterceptorFuncs(changeService(10, &patches)).Build()
+
+		err := MigrateUp(context.TODO(), fc, migrations, WithConflictRetries(2))
+
+		assert.ErrorContains(t, err, "migration patch-service: Service default/test-svc: giving up after 2 retries: resource has changed since it was read")
+		assert.Equal(t, 3, patches)
+	})
+
+	t.Run("negative retries", func(t *testing.T) {
+		var patches int
+		fc := fake.NewClientBuilder().WithObjects(newService()).WithInterceptorFuncs(changeService(10, &patches)).Build()
+
+		err := MigrateUp(context.TODO(), fc, migrations, WithConflictRetries(-1))
+
+		assert.ErrorContains(t, err, "giving up after 0 retries: resource has changed since it was read")
+		assert.Equal(t, 1, patches)
+	})
+
+	t.Run("without optimistic locking", func(t *testing.T) {
+		var patches int
+		fc := fake.NewClientBuilder().WithObjects(newService()).WithInterceptorFuncs(changeService(1, &patches)).Build()
+
+		if err := MigrateUp(context.TODO(), fc, migrations, WithoutOptimisticLock()); err != nil {
+			t.Fatal(err)
+		}
+
+		assert.Equal(t, 1, patches)
+	})
+}
+
+func TestMigrateUp_batches(t *testing.T) {
+	migrations := []Migration{
+		{
+			Name: "migrate-configmaps",
+			Target: Target{
+				PatchTarget: types.PatchTarget{
+					Gvk: gvk.Gvk{
+						Version: "v1",
+						Kind:    "ConfigMap",
+					},
+					Namespace: "default",
+				},
+			},
+			Up: []Patch{
+				{
+					Type:   "application/merge-patch+json",
+					Change: `{"data":{"migrated":"true"}}`,
+				},
+			},
+		},
+	}
+
+	var objs []client.Object
+	for i := 0; i < 5; i++ {
+		objs = append(objs, newConfigMap(func(cm *corev1.ConfigMap) {
+			cm.SetName(fmt.Sprintf("test-cm-%d", i))
+		}))
+	}
+
+	var limits []int64
+	fc := fake.NewClientBuilder().WithObjects(objs...).WithInterceptorFuncs(interceptor.Funcs{
+		List: paginatedList(true, func(listOpts client.ListOptions) {
+			limits = append(limits, listOpts.Limit)
+		}),
+	}).Build()
+	var progress bytes.Buffer
+
+	err := MigrateUp(context.TODO(), fc, migrations,
+		WithBatchSize(2), WithConcurrency(2), WithRateLimit(1000, 10), WithProgress(&progress))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var cms corev1.ConfigMapList
+	if err := fc.List(context.TODO(), &cms); err != nil {
+		t.Fatal(err)
+	}
+	for _, cm := range cms.Items {
+		assert.Equal(t, "true", cm.Data["migrated"], "ConfigMap %s was not migrated", cm.GetName())
+	}
+
+	assert.Equal(t, []int64{2, 2, 2, 0}, limits)
+	want := "migrate-configmaps: migrated 2/5 resources\n" +
+		"migrate-configmaps: migrated 4/5 resources\n" +
+		"migrate-configmaps: migrated 5/5 resources\n"
+	if diff := cmp.Diff(want, progress.String()); diff != "" {
+		t.Errorf("failed to report progress:\n%s", diff)
+	}
+}
+
+func TestMigrateUp_patches_each_page(t *testing.T) {
+	migrations := []Migration{
+		{
+			Name: "migrate-configmaps",
+			Target: Target{
+				PatchTarget: types.PatchTarget{
+					Gvk: gvk.Gvk{
+						Version: "v1",
+						Kind:    "ConfigMap",
+					},
+					Namespace: "default",
+				},
+			},
+			Up: []Patch{
+				{
+					Type:   "application/merge-patch+json",
+					Change: `{"data":{"migrated":"true"}}`,
+				},
+			},
+		},
+	}
+
+	var objs []client.Object
+	for i := 0; i < 3; i++ {
+		objs = append(objs, newConfigMap(func(cm *corev1.ConfigMap) {
+			cm.SetName(fmt.Sprintf("test-cm-%d", i))
+		}))
+	}
+
+	var calls []string
+	fc := fake.NewClientBuilder().WithObjects(objs...).WithInterceptorFuncs(interceptor.Funcs{
+		List: paginatedList(false, func(listOpts client.ListOptions) {
+			calls = append(calls, "list "+listOpts.Continue)
+		}),
+		Patch: func(ctx context.Context, c client.WithWatch, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+			calls = append(calls, "patch "+obj.GetName())
+			return c.Patch(ctx, obj, patch, opts...)
+		},
+	}).Build()
+	var progress bytes.Buffer
+
+	if err := MigrateUp(context.TODO(), fc, migrations, WithBatchSize(2), WithProgress(&progress)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first page is patched before the second page is listed.
+	want := []string{"list ", "patch test-cm-0", "patch test-cm-1", "list 2", "patch test-cm-2"}
+	if diff := cmp.Diff(want, calls); diff != "" {
+		t.Errorf("failed to patch each page:\n%s", diff)
+	}
+
+	// Without the number of remaining resources the total is not known until
+	// the last page.
+	wantProgress := "migrate-configmaps: migrated 2 resources\n" +
+		"migrate-configmaps: migrated 3/3 resources\n"
+	if diff := cmp.Diff(wantProgress, progress.String()); diff != "" {
+		t.Errorf("failed to report progress:\n%s", diff)
+	}
+}
+
+// paginatedList fakes the pagination of lists, which the fake client does not
+// support, with the index of the next item as the continue token.
+//
+// The options of each list are passed to onList.
+func paginatedList(remainingCount bool, onList func(client.ListOptions)) func(context.Context, client.WithWatch, client.ObjectList, ...client.ListOption) error {
+	return func(ctx context.Context, c client.WithWatch, list client.ObjectList, opts ...client.ListOption) error {
+		listOpts := client.ListOptions{}
+		listOpts.ApplyOptions(opts)
+		onList(listOpts)
+
+		if err := c.List(ctx, list, opts...); err != nil || listOpts.Limit == 0 {
+			return err
+		}
+
+		ul := list.(*unstructured.UnstructuredList)
+		total := len(ul.Items)
+		start := 0
+		if listOpts.Continue != "" {
+			start, _ = strconv.Atoi(listOpts.Continue)
+		}
+		end := min(start+int(listOpts.Limit), total)
+		ul.Items = ul.Items[start:end]
+		ul.SetContinue("")
+		if end < total {
+			ul.SetContinue(strconv.Itoa(end))
+			if remainingCount {
+				ul.SetRemainingItemCount(ptr(int64(total - end)))
+			}
+		}
+
+		return nil
+	}
+}
+
+func TestMigrateUp_keep_going(t *testing.T) {
+	migrations := []Migration{
+		{
+			Name: "migrate-configmaps",
+			Target: Target{
+				PatchTarget: types.PatchTarget{
+					Gvk: gvk.Gvk{
+						Version: "v1",
+						Kind:    "ConfigMap",
+					},
+					Namespace: "default",
+				},
+			},
+			Up: []Patch{
+				{
+					Type:   "application/json-patch+json",
+					Change: `[{"op":"replace","path":"/data/testing","value":"migrated"}]`,
+				},
+			},
+		},
+		stepMigrations(1)[0],
+	}
+
+	newClient := func() client.Client {
+		return fake.NewClientBuilder().WithObjects(
+			newConfigMap(func(cm *corev1.ConfigMap) { cm.SetName("test-cm-1") }),
+			newConfigMap(func(cm *corev1.ConfigMap) { cm.SetName("test-cm-2"); cm.Data = nil }),
+			newConfigMap(func(cm *corev1.ConfigMap) { cm.SetName("test-cm-3") }),
+			newConfigMap(func(cm *corev1.ConfigMap) { cm.SetName("test-cm-4"); cm.Data = nil }),
+		).Build()
+	}
+
+	t.Run("stopping at the first failure", func(t *testing.T) {
+		fc := newClient()
+
+		err := MigrateUp(context.TODO(), fc, migrations)
+
+		var resourceErr *ResourceError
+		assert.ErrorAs(t, err, &resourceErr)
+		assert.Equal(t, client.ObjectKey{Name: "test-cm-2", Namespace: "default"}, resourceErr.Key)
+		assert.Equal(t, "test", configMapNamed(t, fc, "test-cm-3").Data["testing"])
+	})
+
+	t.Run("keeping going", func(t *testing.T) {
+		fc := newClient()
+		store := NewConfigMapStateStore(fc, client.ObjectKey{Name: "migrator-state", Namespace: "default"})
+
+		err := MigrateUp(context.TODO(), fc, migrations, WithKeepGoing(), WithStateStore(store))
+
+		var migrationErrs MigrationErrors
+		assert.ErrorAs(t, err, &migrationErrs)
+		var failed []client.ObjectKey
+		for _, resourceErr := range migrationErrs {
+			assert.Equal(t, "migrate-configmaps", resourceErr.Migration)
+			assert.Equal(t, "ConfigMap", resourceErr.GroupVersionKind.Kind)
+			assert.ErrorContains(t, resourceErr, "replace operation does not apply")
+			failed = append(failed, resourceErr.Key)
+		}
+		assert.Equal(t, []client.ObjectKey{
+			{Name: "test-cm-2", Namespace: "default"},
+			{Name: "test-cm-4", Namespace: "default"},
+		}, failed)
+		assert.ErrorContains(t, err, "2 resources failed to migrate:\n  migration migrate-configmaps: ConfigMap default/test-cm-2: replace operation does not apply")
+
+		assert.Equal(t, "migrated", configMapNamed(t, fc, "test-cm-1").Data["testing"])
+		assert.Equal(t, "migrated", configMapNamed(t, fc, "test-cm-3").Data["testing"])
+
+		applied, err := store.Applied(context.TODO())
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Empty(t, applied)
+	})
+
+	t.Run("running again after fixing the failures", func(t *testing.T) {
+		fc := newClient()
+		store := NewConfigMapStateStore(fc, client.ObjectKey{Name: "migrator-state", Namespace: "default"})
+		err := MigrateUp(context.TODO(), fc, migrations[:1], WithKeepGoing(), WithStateStore(store))
+		var migrationErrs MigrationErrors
+		assert.ErrorAs(t, err, &migrationErrs)
+
+		for _, name := range []string{"test-cm-2", "test-cm-4"} {
+			cm := configMapNamed(t, fc, name)
+			cm.Data = map[string]string{"testing": "test"}
+			assert.NoError(t, fc.Update(context.TODO(), cm))
+		}
+
+		// The resources that were migrated are patched again, which leaves
+		// them unchanged.
+		assert.NoError(t, MigrateUp(context.TODO(), fc, migrations[:1], WithKeepGoing(), WithStateStore(store)))
+		for _, name := range []string{"test-cm-1", "test-cm-2", "test-cm-3", "test-cm-4"} {
+			assert.Equal(t, map[string]string{"testing": "migrated"}, configMapNamed(t, fc, name).Data)
+		}
+
+		applied, err := store.Applied(context.TODO())
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Len(t, applied, 1)
+	})
+}
+
+func TestMigrateUp_keep_going_not_idempotent(t *testing.T) {
+	migrations := []Migration{
+		{
+			Name: "add-port",
+			Target: Target{
+				PatchTarget: types.PatchTarget{
+					Gvk:       gvk.Gvk{Version: "v1", Kind: "Service"},
+					Namespace: "default",
+				},
+			},
+			Up: []Patch{
+				{
+					Type:   "application/json-patch+json",
+					Change: `[{"op":"add","path":"/spec/ports/-","value":{"port":8080}}]`,
+				},
+			},
+		},
+	}
+	fc := fake.NewClientBuilder().WithObjects(newService()).Build()
+
+	err := MigrateUp(context.TODO(), fc, migrations, WithKeepGoing())
+
+	assert.ErrorContains(t, err, "migration add-port cannot be executed with keep-going, its patches are not idempotent")
+	var svc corev1.Service
+	assert.NoError(t, fc.Get(context.TODO(), client.ObjectKey{Name: "test-svc", Namespace: "default"}, &svc))
+	assert.Len(t, svc.Spec.Ports, 1)
+}
+
+func configMapNamed(t *testing.T, kubeClient client.Client, name string) *corev1.ConfigMap {
+	t.Helper()
+	var cm corev1.ConfigMap
+	if err := kubeClient.Get(context.TODO(), client.ObjectKey{Name: name, Namespace: "default"}, &cm); err != nil {
+		t.Fatal(err)
+	}
+
+	return &cm
+}
@@ -0,0 +1,264 @@
+package migrator
+
+import (
+	"fmt"
+	"io"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	defaultFieldManager    = "migrator"
+	defaultConflictRetries = 5
+)
+
+// Option configures a migration run.
+type Option func(*options)
+
+type options struct {
+	stateStore       StateStore
+	snapshotStore    SnapshotStore
+	inverseStore     InversePatchStore
+	migrationRecords bool
+	dryRun           DryRun
+	out              io.Writer
+	color            bool
+	downTo           string
+	downSteps        int
+	applyOpts        []ApplyOption
+	fieldManager     string
+	forceConflicts   bool
+	optimisticLock   bool
+	conflictRetries  int
+	batchSize        int
+	concurrency      int
+	limiter          *rate.Limiter
+	progress         io.Writer
+	keepGoing        bool
+	atomic           bool
+}
+
+// DryRun is the mode for running migrations without changing resources.
+type DryRun string
+
+const (
+	// DryRunNone patches resources.
+	DryRunNone DryRun = ""
+	// DryRunClient calculates the patches locally and does not send them.
+	DryRunClient DryRun = "client"
+	// DryRunServer sends the patches to the API server as a dry-run so that
+	// validation and admission webhooks are executed.
+	DryRunServer DryRun = "server"
+)
+
+// WithStateStore configures the StateStore used to record applied migrations.
+//
+// When migrating up, migrations that have already been applied are skipped.
+func WithStateStore(s StateStore) Option {
+	return func(o *options) {
+		o.stateStore = s
+	}
+}
+
+// WithSnapshotStore configures the SnapshotStore used to store resources before
+// they are migrated so that they can be restored with Rollback.
+func WithSnapshotStore(s SnapshotStore) Option {
+	return func(o *options) {
+		o.snapshotStore = s
+	}
+}
+
+// WithInversePatchStore configures the InversePatchStore used to store the
+// inverse patches of migrations without Down patches, so that they can be
+// migrated down.
+//
+// Inverse patches are only recorded when a StateStore is also configured.
+func WithInversePatchStore(s InversePatchStore) Option {
+	return func(o *options) {
+		o.inverseStore = s
+	}
+}
+
+// WithDryRun configures the migrations to be run without changing resources.
+//
+// The patch for each resource is written to the output configured with
+// WithOutput.
+func WithDryRun(d DryRun) Option {
+	return func(o *options) {
+		o.dryRun = d
+	}
+}
+
+// WithOutput configures where reports of the migration are written.
+func WithOutput(w io.Writer) Option {
+	return func(o *options) {
+		o.out = w
+	}
+}
+
+// WithDownTo limits MigrateDown to the migrations after the named migration,
+// which remains applied.
+func WithDownTo(name string) Option {
+	return func(o *options) {
+		o.downTo = name
+	}
+}
+
+// WithDownSteps limits MigrateDown to the last n migrations.
+func WithDownSteps(n int) Option {
+	return func(o *options) {
+		o.downSteps = n
+	}
+}
+
+// WithApplyOptions configures the options used when applying the patches to
+// resources, e.g. WithOpenAPIModels for strategic merge patches of custom
+// resources.
+func WithApplyOptions(opts ...ApplyOption) Option {
+	return func(o *options) {
+		o.applyOpts = append(o.applyOpts, opts...)
+	}
+}
+
+// WithFieldManager configures the field manager that owns the fields that are
+// changed by the migrations, the default is "migrator".
+func WithFieldManager(name string) Option {
+	return func(o *options) {
+		o.fieldManager = name
+	}
+}
+
+// WithForceConflicts configures server-side apply patches to take ownership of
+// fields that are owned by other field managers, rather than failing with a
+// conflict.
+func WithForceConflicts() Option {
+	return func(o *options) {
+		o.forceConflicts = true
+	}
+}
+
+// WithoutOptimisticLock configures the migrations to patch resources without
+// checking that they have not changed since they were read.
+func WithoutOptimisticLock() Option {
+	return func(o *options) {
+		o.optimisticLock = false
+	}
+}
+
+// WithConflictRetries configures the number of times a resource is read and
+// patched again when it changes between reading and patching, the default is
+// 5 and negative numbers are treated as 0.
+func WithConflictRetries(n int) Option {
+	return func(o *options) {
+		o.conflictRetries = n
+	}
+}
+
+// WithBatchSize configures the number of resources that are listed and patched
+// in each batch, the default is to list and patch all resources in a single
+// batch.
+func WithBatchSize(n int) Option {
+	return func(o *options) {
+		o.batchSize = n
+	}
+}
+
+// WithConcurrency configures the number of resources in a batch that are
+// patched in parallel, the default is 1.
+func WithConcurrency(n int) Option {
+	return func(o *options) {
+		o.concurrency = n
+	}
+}
+
+// WithRateLimit limits the rate of patching resources to qps patches per
+// second, with bursts of up to burst patches.
+func WithRateLimit(qps float64, burst int) Option {
+	return func(o *options) {
+		o.limiter = rate.NewLimiter(rate.Limit(qps), burst)
+	}
+}
+
+// WithProgress configures where the progress of each migration is reported,
+// after each batch of resources is patched.
+func WithProgress(w io.Writer) Option {
+	return func(o *options) {
+		o.progress = w
+	}
+}
+
+// WithKeepGoing configures migrations to continue patching the remaining
+// resources when a resource fails to migrate.
+//
+// The failures are returned as MigrationErrors once all the resources have
+// been patched, a migration with failures is not recorded as applied and the
+// later migrations are not executed.
+//
+// Executing the migration again patches the resources that were migrated a
+// second time, so migrations with patches that are not idempotent, e.g. that
+// add to lists or remove fields, are rejected before any resource is patched.
+func WithKeepGoing() Option {
+	return func(o *options) {
+		o.keepGoing = true
+	}
+}
+
+// WithAtomic configures each migration to be applied to all of its resources
+// or none of them, if a resource fails to migrate, the resources that have
+// already been patched are restored to their original versions.
+func WithAtomic() Option {
+	return func(o *options) {
+		o.atomic = true
+	}
+}
+
+func newOptions(opts []Option) *options {
+	o := &options{
+		out:             io.Discard,
+		fieldManager:    defaultFieldManager,
+		optimisticLock:  true,
+		conflictRetries: defaultConflictRetries,
+		concurrency:     1,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	// Resources can be patched concurrently.
+	o.out = &syncWriter{w: o.out}
+
+	return o
+}
+
+// persist returns true if the state of the migrations should be stored.
+func (o *options) persist() bool {
+	return o.dryRun == DryRunNone
+}
+
+func (o *options) reportProgress(migration Migration, migrated, total int) error {
+	if o.progress == nil {
+		return nil
+	}
+	// The total is not known until the last page is listed, unless the
+	// API server returns the number of remaining resources.
+	if total < 0 {
+		_, err := fmt.Fprintf(o.progress, "%s: migrated %d resources\n", migration.Name, migrated)
+		return err
+	}
+	_, err := fmt.Fprintf(o.progress, "%s: migrated %d/%d resources\n", migration.Name, migrated, total)
+
+	return err
+}
+
+// syncWriter serialises writes to an io.Writer.
+type syncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (s *syncWriter) Write(b []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.w.Write(b)
+}
@@ -1,35 +1,240 @@
 package migrator
 
 import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	apitypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/kustomize/v3/pkg/types"
 	"sigs.k8s.io/yaml"
 )
 
+var versionPrefix = regexp.MustCompile(`^(\d+)_`)
+
 // https://github.com/redhat-cop/patch-operator
 // https://pkg.go.dev/k8s.io/apimachinery/pkg/types#PatchType
 
 // Patch provides a generic description of the change to be applied to a
 // resource.
+//
+// The change can be provided as a JSON string in Change, or in a structured
+// form, as a list of Operations for JSON patches, or a Merge object for merge,
+// strategic merge and apply patches.
+//
+// The change can also be read from a file, with a Path that is relative to
+// the migration file.
+//
+// If Template is true, the change is rendered as a Go text/template for each
+// resource before it is applied.
 type Patch struct {
-	Type   apitypes.PatchType `json:"type,omitempty"`
-	Change string             `json:"change,omitempty"`
+	Type       apitypes.PatchType `json:"type,omitempty"`
+	Change     string             `json:"change,omitempty"`
+	Path       string             `json:"path,omitempty"`
+	Template   bool               `json:"template,omitempty"`
+	Operations []Operation        `json:"-"`
+	Merge      map[string]any     `json:"-"`
+}
+
+// Operation is a single JSON Patch operation.
+type Operation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+type patchJSON struct {
+	Type     apitypes.PatchType `json:"type,omitempty"`
+	Change   json.RawMessage    `json:"change,omitempty"`
+	Path     string             `json:"path,omitempty"`
+	Template bool               `json:"template,omitempty"`
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface.
+//
+// The change is parsed as a string, a list of operations or a merge object.
+func (p *Patch) UnmarshalJSON(b []byte) error {
+	var raw patchJSON
+	if err := decodeStrict(b, &raw); err != nil {
+		return err
+	}
+
+	*p = Patch{Type: raw.Type, Path: raw.Path, Template: raw.Template}
+	change := bytes.TrimSpace(raw.Change)
+	if len(change) == 0 || bytes.Equal(change, []byte("null")) {
+		return nil
+	}
+
+	switch change[0] {
+	case '"':
+		return json.Unmarshal(change, &p.Change)
+	case '[':
+		if p.Type != jsonPatchType {
+			return fmt.Errorf("a list of operations can only be used with %s patches", jsonPatchType)
+		}
+		return decodeStrict(change, &p.Operations)
+	case '{':
+		if p.Type != mergePatchType && p.Type != strategicMergePatchType && p.Type != applyPatchType {
+			return fmt.Errorf("an object can only be used with %s, %s or %s patches", mergePatchType, strategicMergePatchType, applyPatchType)
+		}
+		return json.Unmarshal(change, &p.Merge)
+	}
+
+	return fmt.Errorf("invalid change %s", change)
+}
+
+// readPath reads the change of a patch from the file in Path, relative paths
+// are relative to dir.
+func (p *Patch) readPath(dir string) error {
+	if p.Path == "" {
+		return nil
+	}
+	if p.Change != "" || p.Operations != nil || p.Merge != nil {
+		return fmt.Errorf("patch %s has both a path and a change", p.Path)
+	}
+
+	change, err := readPatchFile(dir, p.Path, p.Type, p.Template)
+	if err != nil {
+		return err
+	}
+
+	path := p.Path
+	if err := p.UnmarshalJSON(change); err != nil {
+		return fmt.Errorf("parsing patch %s: %w", path, err)
+	}
+	p.Path = path
+
+	return nil
+}
+
+// readPatchFile reads a patch file and returns a patch with the change from
+// the file, encoded as JSON.
+//
+// The contents of templates, CEL and Starlark patches are used as the change,
+// and the contents of other patches are decoded from YAML or JSON.
+func readPatchFile(dir, path string, patchType apitypes.PatchType, template bool) ([]byte, error) {
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading patch file: %w", err)
+	}
+
+	change, err := json.Marshal(string(b))
+	if err != nil {
+		return nil, err
+	}
+	if !template && patchType != celPatchType && patchType != starlarkPatchType {
+		docs, err := yamlDocuments(b)
+		if err != nil {
+			return nil, fmt.Errorf("parsing patch file %s: %w", path, err)
+		}
+		if len(docs) != 1 {
+			return nil, fmt.Errorf("patch file %s has %d documents, a patch file must have one", path, len(docs))
+		}
+		change = docs[0]
+	}
+
+	return json.Marshal(patchJSON{Type: patchType, Change: change, Template: template})
+}
+
+// yamlDocuments returns each of the documents in a YAML or JSON file encoded
+// as JSON, skipping empty documents.
+func yamlDocuments(b []byte) ([][]byte, error) {
+	var docs [][]byte
+	reader := utilyaml.NewYAMLReader(bufio.NewReader(bytes.NewReader(b)))
+	for {
+		doc, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return docs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		j, err := yaml.YAMLToJSON(doc)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(j, []byte("null")) {
+			docs = append(docs, j)
+		}
+	}
+}
+
+// decodeStrict decodes JSON, rejecting unknown fields.
+//
+// This is needed because the strictness of the decoder is not passed on to
+// implementations of json.Unmarshaler.
+func decodeStrict(b []byte, v any) error {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+
+	return dec.Decode(v)
+}
+
+// MarshalJSON implements the json.Marshaler interface.
+func (p Patch) MarshalJSON() ([]byte, error) {
+	var change any
+	switch {
+	case p.Operations != nil:
+		change = p.Operations
+	case p.Merge != nil:
+		change = p.Merge
+	case p.Change != "":
+		change = p.Change
+	}
+
+	raw := patchJSON{Type: p.Type, Path: p.Path, Template: p.Template}
+	if change != nil {
+		b, err := json.Marshal(change)
+		if err != nil {
+			return nil, err
+		}
+		raw.Change = b
+	}
+
+	return json.Marshal(raw)
+}
+
+// Target identifies the resources that a Migration is applied to.
+//
+// The selectors are in the same format as kustomize patch target selectors.
+type Target struct {
+	types.PatchTarget  `json:",inline"`
+	LabelSelector      string `json:"labelSelector,omitempty"`
+	AnnotationSelector string `json:"annotationSelector,omitempty"`
 }
 
 // Migration describes a change that is applied to a resource.
 type Migration struct {
 	Filename string
-	Name     string            `json:"name"`
-	Target   types.PatchTarget `json:"target"`
-	Up       []Patch           `json:"up"`
-	Down     []Patch           `json:"down,omitempty"`
+	Name     string         `json:"name"`
+	Version  uint64         `json:"version,omitempty"`
+	Target   Target         `json:"target"`
+	When     *Preconditions `json:"when,omitempty"`
+	Up       []Patch        `json:"up"`
+	Down     []Patch        `json:"down,omitempty"`
+	Verify   *Verification  `json:"verify,omitempty"`
 }
 
 // TargetGroupVersionKind returns the GVK for the Target as a GroupVersionKind.
@@ -49,8 +254,47 @@ func (m Migration) TargetObjectKey() client.ObjectKey {
 	}
 }
 
+// Checksum returns a checksum of the Target, preconditions and Up patches,
+// this is used to detect changes to migrations that have already been applied.
+func (m Migration) Checksum() (string, error) {
+	b, err := json.Marshal(struct {
+		Target Target         `json:"target"`
+		When   *Preconditions `json:"when,omitempty"`
+		Up     []Patch        `json:"up"`
+	}{Target: m.Target, When: m.When, Up: m.Up})
+	if err != nil {
+		return "", fmt.Errorf("calculating checksum for migration %s: %w", m.Name, err)
+	}
+	sum := sha256.Sum256(b)
+
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// ParseOption configures the parsing of migrations.
+type ParseOption func(*parseOptions)
+
+type parseOptions struct {
+	disallowGaps bool
+}
+
+// DisallowGaps configures parsing to fail if the versions of the migrations
+// are not consecutive.
+func DisallowGaps() ParseOption {
+	return func(o *parseOptions) {
+		o.disallowGaps = true
+	}
+}
+
 // ParseDirectory parses all the yaml files in the migration directory.
-func ParseDirectory(dir string) ([]Migration, error) {
+//
+// Migrations are versioned with a "version" field, or a numeric prefix on the
+// filename e.g. 0001_migrate_service.yaml, and are returned sorted by version.
+func ParseDirectory(dir string, opts ...ParseOption) ([]Migration, error) {
+	var o parseOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
 	files, err := os.ReadDir(dir)
 	if err != nil {
 		return nil, fmt.Errorf("reading directory %s: %w", dir, err)
@@ -63,16 +307,100 @@ func ParseDirectory(dir string) ([]Migration, error) {
 		if err != nil {
 			return nil, fmt.Errorf("parsing migration %s: %w", fullname, err)
 		}
+
+		if err := validateName(migration.Name); err != nil {
+			return nil, fmt.Errorf("parsing migration %s: %w", fullname, err)
+		}
+
+		if err := parseVersion(migration); err != nil {
+			return nil, fmt.Errorf("parsing migration %s: %w", fullname, err)
+		}
 		migrations = append(migrations, *migration)
 	}
 
+	slices.SortStableFunc(migrations, func(a, b Migration) int {
+		return cmp.Compare(a.Version, b.Version)
+	})
+
+	if err := validateVersions(migrations, o); err != nil {
+		return nil, fmt.Errorf("parsing migrations in %s: %w", dir, err)
+	}
+
 	return migrations, nil
 }
 
+// validateName checks that the name of a migration can be used as the key of
+// its record in the state ConfigMap.
+func validateName(name string) error {
+	if name == "" {
+		return errors.New("migration has no name")
+	}
+	if errs := validation.IsConfigMapKey(name); len(errs) > 0 {
+		return fmt.Errorf("invalid migration name %q: %s", name, strings.Join(errs, ", "))
+	}
+
+	return nil
+}
+
+// parseVersion sets the Version of the migration from the filename prefix,
+// if the migration already has a Version it must match the prefix.
+func parseVersion(migration *Migration) error {
+	match := versionPrefix.FindStringSubmatch(filepath.Base(migration.Filename))
+	if match == nil {
+		return nil
+	}
+
+	version, err := strconv.ParseUint(match[1], 10, 64)
+	if err != nil {
+		return fmt.Errorf("parsing version from filename: %w", err)
+	}
+
+	if migration.Version != 0 && migration.Version != version {
+		return fmt.Errorf("version %d does not match the filename version %d", migration.Version, version)
+	}
+	migration.Version = version
+
+	return nil
+}
+
+// validateVersions checks that the sorted migrations are either all
+// unversioned, or have unique versions, and that all names are unique.
+func validateVersions(migrations []Migration, o parseOptions) error {
+	names := map[string]string{}
+	for i, migration := range migrations {
+		if filename, ok := names[migration.Name]; ok {
+			return fmt.Errorf("duplicate migration name %q in %s and %s", migration.Name, filename, migration.Filename)
+		}
+		names[migration.Name] = migration.Filename
+
+		if i == 0 {
+			continue
+		}
+
+		previous := migrations[i-1]
+		if previous.Version == 0 {
+			if migration.Version != 0 {
+				return fmt.Errorf("migration %s has no version", previous.Filename)
+			}
+			continue
+		}
+
+		if migration.Version == previous.Version {
+			return fmt.Errorf("duplicate migration version %d in %s and %s", migration.Version, previous.Filename, migration.Filename)
+		}
+
+		if o.disallowGaps && migration.Version != previous.Version+1 {
+			return fmt.Errorf("gap in migration versions between %d and %d", previous.Version, migration.Version)
+		}
+	}
+
+	return nil
+}
+
 func filterYAMLFiles(entries []os.DirEntry) []string {
 	var filtered []string
 	for _, e := range entries {
-		if name := e.Name(); strings.HasSuffix(name, ".yaml") || strings.HasSuffix(name, ".yml") {
+		if name := e.Name(); isYAMLFile(name) {
 			filtered = append(filtered, name)
 		}
 	}
@@ -80,6 +408,10 @@ func filterYAMLFiles(entries []os.DirEntry) []string {
 	return filtered
 }
 
+func isYAMLFile(name string) bool {
+	return strings.HasSuffix(name, ".yaml") || strings.HasSuffix(name, ".yml")
+}
+
 func readYAML(filename string) (*Migration, error) {
 	b, err := os.ReadFile(filename)
 	if err != nil {
@@ -87,11 +419,27 @@ func readYAML(filename string) (*Migration, error) {
 	}
 
 	var migration Migration
-	if err := yaml.Unmarshal(b, &migration); err != nil {
+	if err := yaml.UnmarshalStrict(b, &migration); err != nil {
 		return nil, fmt.Errorf("parsing YAML: %w", err)
 	}
 
 	migration.Filename = filename
 
+	for _, patches := range [][]Patch{migration.Up, migration.Down} {
+		for i := range patches {
+			if err := patches[i].readPath(filepath.Dir(filename)); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err := migration.When.validate(); err != nil {
+		return nil, err
+	}
+
+	if err := migration.Verify.validate(migration.Down); err != nil {
+		return nil, err
+	}
+
 	return &migration, nil
 }
@@ -1,8 +1,12 @@
 package migrator
 
 import (
+	"encoding/json"
+	"fmt"
 	"testing"
+	"time"
 
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"sigs.k8s.io/kustomize/v3/pkg/gvk"
 	"sigs.k8s.io/kustomize/v3/pkg/types"
 
@@ -20,14 +24,16 @@ func TestParseDirectory_cluster_resource(t *testing.T) {
 		{
 			Name:     "patch-broken-authconfig-secret-name",
 			Filename: "testdata/clusterresource/patch_secret_name.yaml",
-			Target: types.PatchTarget{
-				Gvk: gvk.Gvk{
-					Group:   "management.cattle.io",
-					Version: "v3",
-					Kind:    "AuthConfig",
+			Target: Target{
+				PatchTarget: types.PatchTarget{
+					Gvk: gvk.Gvk{
+						Group:   "management.cattle.io",
+						Version: "v3",
+						Kind:    "AuthConfig",
+					},
+					Namespace: "",
+					Name:      "shibboleth",
 				},
-				Namespace: "",
-				Name:      "shibboleth",
 			},
 			Up: []Patch{
 				{
@@ -58,14 +64,16 @@ func TestParseDirectory(t *testing.T) {
 		{
 			Name:     "migrate-service",
 			Filename: "testdata/simple/migrate_service.yaml",
-			Target: types.PatchTarget{
-				Gvk: gvk.Gvk{
-					Group:   "",
-					Version: "v1",
-					Kind:    "Service",
+			Target: Target{
+				PatchTarget: types.PatchTarget{
+					Gvk: gvk.Gvk{
+						Group:   "",
+						Version: "v1",
+						Kind:    "Service",
+					},
+					Namespace: "default",
+					Name:      "test-service",
 				},
-				Namespace: "default",
-				Name:      "test-service",
 			},
 			Up: []Patch{
 				{
@@ -96,7 +104,7 @@ func TestParseDirectory_invalid_yaml(t *testing.T) {
 }
 
 func TestParseDirectory_name_ordering(t *testing.T) {
-	// ParseDirectory _currently_ uses os.ReadDir which sorts on name.
+	// The filename prefixes are parsed as versions.
 	migrations, err := ParseDirectory("testdata/ordered")
 	if err != nil {
 		t.Fatal(err)
@@ -116,3 +124,256 @@ func TestParseDirectory_name_ordering(t *testing.T) {
 		t.Fatalf("failed to parse migrations:\n%s", diff)
 	}
 }
+
+func TestParseDirectory_versions(t *testing.T) {
+	migrations, err := ParseDirectory("testdata/versioned")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	versions := collect(migrations, func(m Migration) string {
+		return fmt.Sprintf("%d %s %s", m.Version, m.Name, m.Filename)
+	})
+	want := []string{
+		"1 first testdata/versioned/1_first.yaml",
+		"2 second testdata/versioned/2_second.yaml",
+		"3 third testdata/versioned/third.yaml",
+		"10 tenth testdata/versioned/10_tenth.yaml",
+	}
+	if diff := cmp.Diff(want, versions); diff != "" {
+		t.Fatalf("failed to parse migrations:\n%s", diff)
+	}
+}
+
+func TestParseDirectory_version_errors(t *testing.T) {
+	versionTests := []struct {
+		dir     string
+		opts    []ParseOption
+		wantErr string
+	}{
+		{
+			dir:     "testdata/duplicate_versions",
+			wantErr: "duplicate migration version 1 in testdata/duplicate_versions/01_second.yaml and testdata/duplicate_versions/1_first.yaml",
+		},
+		{
+			dir:     "testdata/duplicate_names",
+			wantErr: `duplicate migration name "first" in testdata/duplicate_names/1_first.yaml and testdata/duplicate_names/2_second.yaml`,
+		},
+		{
+			dir:     "testdata/invalid_name",
+			wantErr: `parsing migration testdata/invalid_name/1_add_item.yaml: invalid migration name "add item"`,
+		},
+		{
+			dir:     "testdata/rollback_without_down",
+			wantErr: "parsing migration testdata/rollback_without_down/1_update_image.yaml: verify.rollbackOnFailure requires down patches",
+		},
+		{
+			dir:     "testdata/version_mismatch",
+			wantErr: "parsing migration testdata/version_mismatch/1_first.yaml: version 2 does not match the filename version 1",
+		},
+		{
+			dir:     "testdata/unversioned_migration",
+			wantErr: "migration testdata/unversioned_migration/second.yaml has no version",
+		},
+		{
+			dir:     "testdata/versioned",
+			opts:    []ParseOption{DisallowGaps()},
+			wantErr: "gap in migration versions between 3 and 10",
+		},
+	}
+
+	for _, tt := range versionTests {
+		t.Run(tt.dir, func(t *testing.T) {
+			_, err := ParseDirectory(tt.dir, tt.opts...)
+			assert.ErrorContains(t, err, tt.wantErr)
+		})
+	}
+}
+
+func TestParseDirectory_structured_patches(t *testing.T) {
+	migrations, err := ParseDirectory("testdata/structured")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Migration{
+		{
+			Name:     "migrate-service",
+			Filename: "testdata/structured/migrate_service.yaml",
+			Target: Target{
+				PatchTarget: types.PatchTarget{
+					Gvk: gvk.Gvk{
+						Version: "v1",
+						Kind:    "Service",
+					},
+					Namespace: "default",
+					Name:      "test-service",
+				},
+			},
+			Up: []Patch{
+				{
+					Type: "application/json-patch+json",
+					Operations: []Operation{
+						{Op: "replace", Path: "/spec/ports/0/targetPort", Value: json.RawMessage(`9371`)},
+						{Op: "copy", From: "/metadata/name", Path: "/metadata/labels/app"},
+					},
+				},
+				{
+					Type: "application/merge-patch+json",
+					Merge: map[string]any{
+						"metadata": map[string]any{
+							"annotations": map[string]any{
+								"example.com/migrated": "true",
+								"example.com/legacy":   nil,
+							},
+						},
+					},
+				},
+			},
+			Down: []Patch{
+				{
+					Type:   "application/json-patch+json",
+					Change: `[{"op":"replace","path":"/spec/ports/0/targetPort","value":9376}]`,
+				},
+			},
+		},
+	}
+	if diff := cmp.Diff(want, migrations); diff != "" {
+		t.Fatalf("failed to parse migrations:\n%s", diff)
+	}
+}
+
+func TestParseDirectory_invalid_structured_patch(t *testing.T) {
+	_, err := ParseDirectory("testdata/structured_invalid")
+	assert.ErrorContains(t, err, "a list of operations can only be used with application/json-patch+json patches")
+}
+
+func TestPatch_MarshalJSON(t *testing.T) {
+	marshalTests := []struct {
+		name  string
+		patch Patch
+		want  string
+	}{
+		{
+			name:  "string change",
+			patch: Patch{Type: "application/json-patch+json", Change: `[{"op":"remove","path":"/data/testing"}]`},
+			want:  `{"type":"application/json-patch+json","change":"[{\"op\":\"remove\",\"path\":\"/data/testing\"}]"}`,
+		},
+		{
+			name: "operations",
+			patch: Patch{Type: "application/json-patch+json", Operations: []Operation{
+				{Op: "add", Path: "/data/testing", Value: json.RawMessage(`null`)},
+			}},
+			want: `{"type":"application/json-patch+json","change":[{"op":"add","path":"/data/testing","value":null}]}`,
+		},
+		{
+			name:  "merge",
+			patch: Patch{Type: "application/merge-patch+json", Merge: map[string]any{"data": map[string]any{"testing": "value"}}},
+			want:  `{"type":"application/merge-patch+json","change":{"data":{"testing":"value"}}}`,
+		},
+	}
+
+	for _, tt := range marshalTests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := json.Marshal(tt.patch)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.JSONEq(t, tt.want, string(b))
+
+			var parsed Patch
+			if err := json.Unmarshal(b, &parsed); err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tt.patch, parsed); diff != "" {
+				t.Fatalf("failed to round-trip patch:\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestParseDirectory_preconditions(t *testing.T) {
+	migrations, err := ParseDirectory("testdata/preconditions")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := &Preconditions{
+		Fields:     []FieldCondition{{Path: "{.spec.type}", Equals: ptr("ClusterIP")}},
+		Labels:     []string{"app"},
+		Generation: &GenerationRange{Min: 1},
+	}
+	if diff := cmp.Diff(want, migrations[0].When); diff != "" {
+		t.Fatalf("failed to parse preconditions:\n%s", diff)
+	}
+}
+
+func TestParseDirectory_invalid_preconditions(t *testing.T) {
+	_, err := ParseDirectory("testdata/preconditions_invalid")
+	assert.ErrorContains(t, err, `parsing migration testdata/preconditions_invalid/migrate_service.yaml: parsing field path "{.spec.type"`)
+}
+
+func TestParseDirectory_verify(t *testing.T) {
+	migrations, err := ParseDirectory("testdata/verify")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := &Verification{
+		Conditions:         []ConditionCheck{{Type: "Available", Status: "True"}},
+		ObservedGeneration: true,
+		Fields:             []FieldCondition{{Path: "{.status.updatedReplicas}", Equals: ptr("3")}},
+		Timeout:            metav1.Duration{Duration: 2 * time.Minute},
+		RollbackOnFailure:  true,
+	}
+	if diff := cmp.Diff(want, migrations[0].Verify); diff != "" {
+		t.Fatalf("failed to parse verification:\n%s", diff)
+	}
+}
+
+func TestParseDirectory_unknown_field(t *testing.T) {
+	_, err := ParseDirectory("testdata/unknown_field")
+	assert.ErrorContains(t, err, `parsing migration testdata/unknown_field/migrate_service.yaml: parsing YAML: error unmarshaling JSON: while decoding JSON: json: unknown field "tpye"`)
+}
+
+func TestParseDirectory_patch_files(t *testing.T) {
+	migrations, err := ParseDirectory("testdata/patch_files")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantUp := []Patch{
+		{
+			Type: "application/json-patch+json",
+			Path: "patches/port_8080.yaml",
+			Operations: []Operation{
+				{Op: "replace", Path: "/spec/ports/0/port", Value: json.RawMessage(`8080`)},
+			},
+		},
+	}
+	if diff := cmp.Diff(wantUp, migrations[0].Up); diff != "" {
+		t.Fatalf("failed to parse up patches:\n%s", diff)
+	}
+	wantDown := []Patch{
+		{
+			Type: "application/json-patch+json",
+			Path: "patches/port_80.json",
+			Operations: []Operation{
+				{Op: "replace", Path: "/spec/ports/0/port", Value: json.RawMessage(`80`)},
+			},
+		},
+	}
+	if diff := cmp.Diff(wantDown, migrations[0].Down); diff != "" {
+		t.Fatalf("failed to parse down patches:\n%s", diff)
+	}
+}
+
+func TestParseDirectory_missing_patch_file(t *testing.T) {
+	_, err := ParseDirectory("testdata/patch_files_invalid")
+	assert.ErrorContains(t, err, "parsing migration testdata/patch_files_invalid/1_missing.yaml: reading patch file: open testdata/patch_files_invalid/patches/missing.yaml: no such file or directory")
+}
+
+func TestParseDirectory_multiple_documents_in_patch_file(t *testing.T) {
+	_, err := ParseDirectory("testdata/patch_files_multiple")
+	assert.EqualError(t, err, "parsing migration testdata/patch_files_multiple/1_replicas.yaml: patch file testdata/patch_files_multiple/patches/deployments.yaml has 2 documents, a patch file must have one")
+}
@@ -0,0 +1,148 @@
+package migrator
+
+import (
+	"bytes"
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/util/jsonpath"
+)
+
+// Preconditions must hold for a resource before the patches of a migration are
+// applied to it, resources that fail the preconditions are skipped.
+type Preconditions struct {
+	Fields      []FieldCondition `json:"fields,omitempty"`
+	Labels      []string         `json:"labels,omitempty"`
+	Annotations []string         `json:"annotations,omitempty"`
+	Generation  *GenerationRange `json:"generation,omitempty"`
+}
+
+// FieldCondition checks the value of a field identified by a JSONPath
+// expression e.g. {.spec.type}.
+//
+// If Equals is not provided, the field must exist.
+type FieldCondition struct {
+	Path   string  `json:"path"`
+	Equals *string `json:"equals,omitempty"`
+}
+
+// GenerationRange is an inclusive range of metadata.generation values.
+//
+// The generation is used rather than the resourceVersion, which is opaque and
+// cannot be compared.
+type GenerationRange struct {
+	Min int64 `json:"min,omitempty"`
+	Max int64 `json:"max,omitempty"`
+}
+
+// validate checks that the JSONPath expressions can be parsed.
+func (p *Preconditions) validate() error {
+	if p == nil {
+		return nil
+	}
+
+	for _, field := range p.Fields {
+		if _, err := parseJSONPath(field.Path); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// check returns the reason that the resource fails the preconditions, or an
+// empty string if the preconditions hold.
+func (p *Preconditions) check(u *unstructured.Unstructured) (string, error) {
+	if p == nil {
+		return "", nil
+	}
+
+	for _, field := range p.Fields {
+		reason, err := field.check(u)
+		if err != nil || reason != "" {
+			return reason, err
+		}
+	}
+
+	for _, label := range p.Labels {
+		if _, ok := u.GetLabels()[label]; !ok {
+			return fmt.Sprintf("label %s is missing", label), nil
+		}
+	}
+
+	for _, annotation := range p.Annotations {
+		if _, ok := u.GetAnnotations()[annotation]; !ok {
+			return fmt.Sprintf("annotation %s is missing", annotation), nil
+		}
+	}
+
+	if r := p.Generation; r != nil {
+		generation := u.GetGeneration()
+		if generation < r.Min || (r.Max != 0 && generation > r.Max) {
+			return fmt.Sprintf("generation %d is not in the range %d to %d", generation, r.Min, r.Max), nil
+		}
+	}
+
+	return "", nil
+}
+
+func (f FieldCondition) check(u *unstructured.Unstructured) (string, error) {
+	jp, err := parseJSONPath(f.Path)
+	if err != nil {
+		return "", err
+	}
+
+	results, err := jp.FindResults(u.Object)
+	if err != nil || len(results) == 0 || len(results[0]) == 0 {
+		return fmt.Sprintf("field %s is missing", f.Path), nil
+	}
+
+	if f.Equals == nil {
+		return "", nil
+	}
+
+	var b bytes.Buffer
+	if err := jp.PrintResults(&b, results[0]); err != nil {
+		return "", fmt.Errorf("printing field %s: %w", f.Path, err)
+	}
+	if b.String() != *f.Equals {
+		return fmt.Sprintf("field %s is %q not %q", f.Path, b.String(), *f.Equals), nil
+	}
+
+	return "", nil
+}
+
+func parseJSONPath(path string) (*jsonpath.JSONPath, error) {
+	jp := jsonpath.New(path).AllowMissingKeys(false)
+	if err := jp.Parse(path); err != nil {
+		return nil, fmt.Errorf("parsing field path %q: %w", path, err)
+	}
+
+	return jp, nil
+}
+
+// filterPreconditions returns the resources that pass the preconditions of
+// the migration, skip is called with the reason for each resource that fails.
+func filterPreconditions(migration Migration, resources []unstructured.Unstructured, skip func(*unstructured.Unstructured, string) error) ([]unstructured.Unstructured, error) {
+	if migration.When == nil {
+		return resources, nil
+	}
+
+	var filtered []unstructured.Unstructured
+	for _, resource := range resources {
+		reason, err := migration.When.check(&resource)
+		if err != nil {
+			return nil, fmt.Errorf("checking preconditions of migration %s: %w", migration.Name, err)
+		}
+
+		if reason != "" {
+			if err := skip(&resource, reason); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		filtered = append(filtered, resource)
+	}
+
+	return filtered, nil
+}
@@ -0,0 +1,202 @@
+package migrator
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/kustomize/v3/pkg/gvk"
+	"sigs.k8s.io/kustomize/v3/pkg/types"
+)
+
+func TestPreconditions_check(t *testing.T) {
+	svc := toUnstructured(t, newService(
+		withLabels(map[string]string{"app": "test"}),
+		withAnnotations(map[string]string{"owner": "platform"}),
+	))
+	svc.SetGeneration(150)
+
+	checkTests := []struct {
+		name          string
+		preconditions *Preconditions
+		want          string
+	}{
+		{
+			name: "no preconditions",
+		},
+		{
+			name:          "field exists",
+			preconditions: &Preconditions{Fields: []FieldCondition{{Path: "{.spec.ports[0].port}"}}},
+		},
+		{
+			name:          "field is missing",
+			preconditions: &Preconditions{Fields: []FieldCondition{{Path: "{.spec.type}"}}},
+			want:          "field {.spec.type} is missing",
+		},
+		{
+			name:          "field equals",
+			preconditions: &Preconditions{Fields: []FieldCondition{{Path: "{.spec.ports[0].port}", Equals: ptr("80")}}},
+		},
+		{
+			name:          "field does not equal",
+			preconditions: &Preconditions{Fields: []FieldCondition{{Path: "{.spec.ports[0].name}", Equals: ptr("https")}}},
+			want:          `field {.spec.ports[0].name} is "http-80" not "https"`,
+		},
+		{
+			name:          "label exists",
+			preconditions: &Preconditions{Labels: []string{"app"}},
+		},
+		{
+			name:          "label is missing",
+			preconditions: &Preconditions{Labels: []string{"tier"}},
+			want:          "label tier is missing",
+		},
+		{
+			name:          "annotation exists",
+			preconditions: &Preconditions{Annotations: []string{"owner"}},
+		},
+		{
+			name:          "annotation is missing",
+			preconditions: &Preconditions{Annotations: []string{"team"}},
+			want:          "annotation team is missing",
+		},
+		{
+			name:          "generation in range",
+			preconditions: &Preconditions{Generation: &GenerationRange{Min: 100, Max: 200}},
+		},
+		{
+			name:          "generation above minimum",
+			preconditions: &Preconditions{Generation: &GenerationRange{Min: 100}},
+		},
+		{
+			name:          "generation out of range",
+			preconditions: &Preconditions{Generation: &GenerationRange{Min: 10, Max: 20}},
+			want:          "generation 150 is not in the range 10 to 20",
+		},
+	}
+
+	for _, tt := range checkTests {
+		t.Run(tt.name, func(t *testing.T) {
+			reason, err := tt.preconditions.check(svc)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, reason)
+		})
+	}
+}
+
+func TestPreconditions_validate(t *testing.T) {
+	preconditions := &Preconditions{Fields: []FieldCondition{{Path: "{.spec.ports[0"}}}
+
+	assert.ErrorContains(t, preconditions.validate(), `parsing field path "{.spec.ports[0"`)
+}
+
+func TestMigrateUp_preconditions(t *testing.T) {
+	migrations := []Migration{
+		{
+			Name: "patch-services",
+			Target: Target{
+				PatchTarget: types.PatchTarget{
+					Gvk: gvk.Gvk{
+						Version: "v1",
+						Kind:    "Service",
+					},
+					Namespace: "default",
+				},
+			},
+			When: &Preconditions{
+				Labels: []string{"app"},
+			},
+			Up: []Patch{
+				{
+					Type:   "application/json-patch+json",
+					Change: `[{"op":"test","path":"/metadata/labels/app","value":"test"},{"op":"replace","path":"/spec/ports/0/port","value":81}]`,
+				},
+			},
+		},
+	}
+	fc := fake.NewClientBuilder().WithObjects(
+		newService(withName("svc-1"), withLabels(map[string]string{"app": "test"})),
+		newService(withName("svc-2")),
+	).Build()
+	var out bytes.Buffer
+
+	if err := MigrateUp(context.TODO(), fc, migrations, WithOutput(&out)); err != nil {
+		t.Fatal(err)
+	}
+
+	var svcList corev1.ServiceList
+	if err := fc.List(context.TODO(), &svcList, client.InNamespace("default")); err != nil {
+		t.Fatal(err)
+	}
+	ports := map[string]int32{}
+	for _, svc := range svcList.Items {
+		ports[svc.GetName()] = svc.Spec.Ports[0].Port
+	}
+	if diff := cmp.Diff(map[string]int32{"svc-1": 81, "svc-2": 80}, ports); diff != "" {
+		t.Errorf("failed to migrate:\n%s", diff)
+	}
+	assert.Equal(t, "Service default/svc-2: skipped, label app is missing\n", out.String())
+}
+
+func TestMigrateDown_preconditions(t *testing.T) {
+	migrations, err := ParseDirectory("testdata/preconditions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fc := fake.NewClientBuilder().WithObjects(
+		newService(withLabels(map[string]string{"app": "test"}), func(s *corev1.Service) {
+			s.Spec.Type = corev1.ServiceTypeClusterIP
+			s.SetGeneration(1)
+		}),
+	).Build()
+	store := NewConfigMapStateStore(fc, client.ObjectKey{Name: "migrator-state", Namespace: "default"})
+
+	if err := MigrateUp(context.TODO(), fc, migrations, WithStateStore(store)); err != nil {
+		t.Fatal(err)
+	}
+	var svc corev1.Service
+	assert.NoError(t, fc.Get(context.TODO(), client.ObjectKey{Name: "test-svc", Namespace: "default"}, &svc))
+	assert.Equal(t, corev1.ServiceTypeNodePort, svc.Spec.Type)
+
+	// The Service no longer passes the preconditions, which are only checked
+	// when migrating up.
+	if err := MigrateDown(context.TODO(), fc, migrations, WithStateStore(store)); err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, fc.Get(context.TODO(), client.ObjectKey{Name: "test-svc", Namespace: "default"}, &svc))
+	assert.Equal(t, corev1.ServiceTypeClusterIP, svc.Spec.Type)
+}
+
+func TestMigrateDirectoryDown_preconditions(t *testing.T) {
+	migrations, err := ParseDirectory("testdata/preconditions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Resources in files do not have a generation.
+	migrations[0].When.Generation = nil
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "service.yaml")
+	assert.NoError(t, os.WriteFile(filename, []byte(`apiVersion: v1
+kind: Service
+metadata:
+  name: test-svc
+  namespace: default
+  labels:
+    app: test
+spec:
+  type: ClusterIP
+`), 0o644))
+
+	assert.NoError(t, MigrateDirectoryUp(dir, migrations))
+	assert.Contains(t, readFile(t, filename), "type: NodePort")
+
+	assert.NoError(t, MigrateDirectoryDown(dir, migrations))
+	assert.Contains(t, readFile(t, filename), "type: ClusterIP")
+}
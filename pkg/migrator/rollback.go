@@ -0,0 +1,125 @@
+package migrator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Rollback restores the resources that were patched by the named migration to
+// the versions stored in the SnapshotStore before the migration was applied.
+//
+// A SnapshotStore must be configured with WithSnapshotStore, and the snapshot
+// and any inverse patches for the migration are deleted.
+func Rollback(ctx context.Context, kubeClient client.Client, migrationName string, opts ...Option) error {
+	o := newOptions(opts)
+	if o.snapshotStore == nil {
+		return errors.New("rolling back requires a snapshot store")
+	}
+
+	originals, err := o.snapshotStore.Load(ctx, migrationName)
+	if err != nil {
+		return fmt.Errorf("loading snapshot for migration %s: %w", migrationName, err)
+	}
+
+	for _, original := range originals {
+		if err := restoreResource(ctx, kubeClient, &original); err != nil {
+			return fmt.Errorf("rolling back migration %s: %w", migrationName, err)
+		}
+	}
+
+	if o.stateStore != nil {
+		if err := o.stateStore.Remove(ctx, migrationName); err != nil {
+			return fmt.Errorf("removing record of migration %s: %w", migrationName, err)
+		}
+	}
+
+	if o.inverseStore != nil {
+		if err := o.inverseStore.Delete(ctx, migrationName); err != nil {
+			return err
+		}
+	}
+
+	return o.snapshotStore.Delete(ctx, migrationName)
+}
+
+// restoreResource patches the current version of a resource back to the
+// original.
+//
+// The fields that are managed by the API server are taken from the current
+// version so that the computed patch only contains the migrated changes.
+func restoreResource(ctx context.Context, kubeClient client.Client, original *unstructured.Unstructured) error {
+	current := &unstructured.Unstructured{}
+	current.SetGroupVersionKind(original.GroupVersionKind())
+	if err := kubeClient.Get(ctx, client.ObjectKeyFromObject(original), current); err != nil {
+		return fmt.Errorf("getting %s %s: %w", original.GetKind(), client.ObjectKeyFromObject(original), err)
+	}
+
+	restored := original.DeepCopy()
+	restored.SetResourceVersion(current.GetResourceVersion())
+	restored.SetManagedFields(current.GetManagedFields())
+	restored.SetGeneration(current.GetGeneration())
+	restored.SetUID(current.GetUID())
+	restored.SetCreationTimestamp(current.GetCreationTimestamp())
+	if status, ok := current.Object["status"]; ok {
+		restored.Object["status"] = status
+	} else {
+		delete(restored.Object, "status")
+	}
+
+	if err := kubeClient.Patch(ctx, restored, client.MergeFrom(current)); err != nil {
+		return fmt.Errorf("restoring %s %s: %w", original.GetKind(), client.ObjectKeyFromObject(original), err)
+	}
+
+	return nil
+}
+
+// compensator keeps the original versions of the resources that have been
+// patched by a migration so that they can be restored if the migration fails.
+//
+// A nil compensator keeps nothing.
+type compensator struct {
+	mu        sync.Mutex
+	originals []*unstructured.Unstructured
+}
+
+func newCompensator() *compensator {
+	return &compensator{}
+}
+
+// patched keeps the original version of a patched resource.
+func (c *compensator) patched(original *unstructured.Unstructured) {
+	if c == nil || original == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.originals = append(c.originals, original)
+}
+
+// restore restores the patched resources to their original versions, in the
+// reverse order that they were patched.
+//
+// The resources that cannot be restored are logged to w.
+func (c *compensator) restore(ctx context.Context, kubeClient client.Client, w io.Writer) error {
+	if c == nil {
+		return nil
+	}
+
+	var errs []error
+	for i := len(c.originals) - 1; i >= 0; i-- {
+		original := c.originals[i]
+		if err := restoreResource(ctx, kubeClient, original); err != nil {
+			fmt.Fprintf(w, "failed to revert: %s\n", err)
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
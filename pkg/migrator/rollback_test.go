@@ -0,0 +1,224 @@
+package migrator
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+	"sigs.k8s.io/kustomize/v3/pkg/gvk"
+	"sigs.k8s.io/kustomize/v3/pkg/types"
+)
+
+func TestRollback(t *testing.T) {
+	migrations := []Migration{
+		{
+			Name:     "patch-service",
+			Filename: "testdata/simple.yaml",
+			Target: Target{
+				PatchTarget: types.PatchTarget{
+					Gvk: gvk.Gvk{
+						Group:   "",
+						Version: "v1",
+						Kind:    "Service",
+					},
+					Namespace: "default",
+				},
+			},
+			Up: []Patch{
+				{
+					Type:   "application/json-patch+json",
+					Change: `[{"op":"add","path":"/spec/ports/-","value":{"name":"https","port":443,"protocol":"TCP"}},{"op":"add","path":"/metadata/labels","value":{"migrated":"true"}}]`,
+				},
+			},
+		},
+	}
+
+	fc := fake.NewClientBuilder().WithObjects(
+		createService(withName("svc-1")),
+		createService(withName("svc-2"))).Build()
+	stateStore := NewConfigMapStateStore(fc, client.ObjectKey{Name: "migrator-state", Namespace: "default"})
+	snapshotStore := NewSecretSnapshotStore(fc, "default")
+	inverseStore := NewSecretInversePatchStore(fc, "default")
+
+	if err := MigrateUp(context.TODO(), fc, migrations, WithStateStore(stateStore), WithSnapshotStore(snapshotStore), WithInversePatchStore(inverseStore)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Rollback(context.TODO(), fc, "patch-service", WithStateStore(stateStore), WithSnapshotStore(snapshotStore), WithInversePatchStore(inverseStore)); err != nil {
+		t.Fatal(err)
+	}
+
+	var svcList corev1.ServiceList
+	if err := fc.List(context.TODO(), &svcList, client.InNamespace("default")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, svc := range svcList.Items {
+		want := []corev1.ServicePort{
+			{
+				Protocol:   "TCP",
+				Port:       80,
+				TargetPort: intstr.FromInt(9376),
+			},
+		}
+		if diff := cmp.Diff(want, svc.Spec.Ports); diff != "" {
+			t.Errorf("failed to rollback %s:\n%s", svc.GetName(), diff)
+		}
+		assert.Empty(t, svc.GetLabels())
+	}
+
+	applied, err := stateStore.Applied(context.TODO())
+	assert.NoError(t, err)
+	assert.Empty(t, applied)
+
+	_, err = snapshotStore.Load(context.TODO(), "patch-service")
+	assert.ErrorContains(t, err, "not found")
+	_, err = inverseStore.Load(context.TODO(), "patch-service")
+	assert.ErrorContains(t, err, "not found")
+}
+
+func TestRollback_failed_migration(t *testing.T) {
+	migrations := []Migration{
+		{
+			Name: "patch-service",
+			Target: Target{
+				PatchTarget: types.PatchTarget{
+					Gvk:       gvk.Gvk{Version: "v1", Kind: "Service"},
+					Namespace: "default",
+				},
+			},
+			Up: []Patch{
+				{
+					Type:   "application/merge-patch+json",
+					Change: `{"metadata":{"annotations":{"migrated":"true"}}}`,
+				},
+			},
+		},
+	}
+
+	failing := true
+	fc := fake.NewClientBuilder().WithObjects(
+		createService(withName("svc-1")),
+		createService(withName("svc-2")),
+	).WithInterceptorFuncs(interceptor.Funcs{
+		Patch: func(ctx context.Context, c client.WithWatch, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+			if failing && obj.GetName() == "svc-2" {
+				return errors.New("failed to patch")
+			}
+
+			return c.Patch(ctx, obj, patch, opts...)
+		},
+	}).Build()
+	stateStore := NewConfigMapStateStore(fc, client.ObjectKey{Name: "migrator-state", Namespace: "default"})
+	snapshotStore := NewSecretSnapshotStore(fc, "default")
+
+	err := MigrateUp(context.TODO(), fc, migrations, WithStateStore(stateStore), WithSnapshotStore(snapshotStore))
+	assert.ErrorContains(t, err, "failed to patch")
+
+	// The second run keeps the snapshot of svc-1 from before the first run.
+	failing = false
+	if err := MigrateUp(context.TODO(), fc, migrations, WithStateStore(stateStore), WithSnapshotStore(snapshotStore)); err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err := snapshotStore.Load(context.TODO(), "patch-service")
+	assert.NoError(t, err)
+	assert.Len(t, snapshot, 2)
+
+	if err := Rollback(context.TODO(), fc, "patch-service", WithStateStore(stateStore), WithSnapshotStore(snapshotStore)); err != nil {
+		t.Fatal(err)
+	}
+
+	var svcList corev1.ServiceList
+	if err := fc.List(context.TODO(), &svcList, client.InNamespace("default")); err != nil {
+		t.Fatal(err)
+	}
+	for _, svc := range svcList.Items {
+		assert.Empty(t, svc.GetAnnotations(), svc.GetName())
+	}
+}
+
+func TestRollback_no_snapshot_store(t *testing.T) {
+	err := Rollback(context.TODO(), newFakeClient(), "patch-service")
+	assert.ErrorContains(t, err, "rolling back requires a snapshot store")
+}
+
+func TestRollback_missing_snapshot(t *testing.T) {
+	fc := newFakeClient()
+
+	err := Rollback(context.TODO(), fc, "patch-service", WithSnapshotStore(NewSecretSnapshotStore(fc, "default")))
+	assert.ErrorContains(t, err, "loading snapshot for migration patch-service")
+}
+
+func TestMigrateUp_atomic(t *testing.T) {
+	migrations := []Migration{
+		{
+			Name: "migrate-configmaps",
+			Target: Target{
+				PatchTarget: types.PatchTarget{
+					Gvk: gvk.Gvk{
+						Version: "v1",
+						Kind:    "ConfigMap",
+					},
+					Namespace: "default",
+				},
+			},
+			Up: []Patch{
+				{
+					Type:   "application/json-patch+json",
+					Change: `[{"op":"replace","path":"/data/testing","value":"migrated"}]`,
+				},
+			},
+		},
+	}
+
+	objs := []client.Object{
+		newConfigMap(func(cm *corev1.ConfigMap) { cm.SetName("test-cm-1") }),
+		newConfigMap(func(cm *corev1.ConfigMap) { cm.SetName("test-cm-2") }),
+		newConfigMap(func(cm *corev1.ConfigMap) { cm.SetName("test-cm-3"); cm.Data = nil }),
+		newConfigMap(func(cm *corev1.ConfigMap) { cm.SetName("test-cm-4") }),
+	}
+
+	t.Run("restoring the patched resources", func(t *testing.T) {
+		fc := fake.NewClientBuilder().WithObjects(objs...).Build()
+
+		err := MigrateUp(context.TODO(), fc, migrations, WithAtomic())
+		assert.ErrorContains(t, err, "migration migrate-configmaps: ConfigMap default/test-cm-3: replace operation does not apply")
+
+		for _, name := range []string{"test-cm-1", "test-cm-2", "test-cm-4"} {
+			assert.Equal(t, map[string]string{"testing": "test"}, configMapNamed(t, fc, name).Data, "ConfigMap %s was not restored", name)
+		}
+	})
+
+	t.Run("failing to restore a resource", func(t *testing.T) {
+		fc := fake.NewClientBuilder().WithObjects(objs...).WithInterceptorFuncs(interceptor.Funcs{
+			Patch: func(ctx context.Context, c client.WithWatch, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+				data, err := patch.Data(obj)
+				if err != nil {
+					return err
+				}
+				if obj.GetName() == "test-cm-1" && strings.Contains(string(data), `"testing":"test"`) {
+					return errors.New("restore failed")
+				}
+
+				return c.Patch(ctx, obj, patch, opts...)
+			},
+		}).Build()
+		var out bytes.Buffer
+
+		err := MigrateUp(context.TODO(), fc, migrations, WithAtomic(), WithOutput(&out))
+		assert.ErrorContains(t, err, "reverting migration migrate-configmaps: restoring ConfigMap default/test-cm-1: restore failed")
+
+		assert.Equal(t, "failed to revert: restoring ConfigMap default/test-cm-1: restore failed\n", out.String())
+		assert.Equal(t, "migrated", configMapNamed(t, fc, "test-cm-1").Data["testing"])
+		assert.Equal(t, "test", configMapNamed(t, fc, "test-cm-2").Data["testing"])
+	})
+}
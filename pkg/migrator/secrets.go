@@ -0,0 +1,195 @@
+package migrator
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// migrationAnnotation records the name of the migration on the Secrets
+	// that store data for it, the names of the Secrets are derived from a
+	// hash of the migration name.
+	migrationAnnotation = "migrator.gitops.tools/migration"
+	// chunkAnnotation is the index of the chunk of the data in each Secret.
+	chunkAnnotation = "migrator.gitops.tools/chunk"
+	// chunkKey is the key of the data in each Secret.
+	chunkKey = "data.json"
+	// maxChunkSize is the maximum size of the data in each Secret, leaving
+	// room for the metadata below the 1 MiB limit on the size of objects.
+	maxChunkSize = 768 * 1024
+)
+
+// secretChunks stores lists in Secrets, split into as many Secrets as are
+// needed to stay below the size limit of objects.
+//
+// The Secrets for a migration are named with the prefix and a hash of the
+// migration name, and are labelled with the hash so that they can be found.
+type secretChunks struct {
+	kubeClient client.Client
+	namespace  string
+	prefix     string
+	label      string
+}
+
+// saveChunks replaces the Secrets for the migration with the items.
+func saveChunks[T any](ctx context.Context, s secretChunks, migrationName string, items []T) error {
+	chunks, err := splitChunks(items)
+	if err != nil {
+		return err
+	}
+
+	if err := s.delete(ctx, migrationName); err != nil {
+		return err
+	}
+
+	return s.create(ctx, migrationName, 0, chunks)
+}
+
+// appendChunks adds the items to the Secrets for the migration.
+func appendChunks[T any](ctx context.Context, s secretChunks, migrationName string, items []T) error {
+	chunks, err := splitChunks(items)
+	if err != nil {
+		return err
+	}
+
+	existing, err := s.list(ctx, migrationName)
+	if err != nil {
+		return err
+	}
+
+	return s.create(ctx, migrationName, len(existing), chunks)
+}
+
+// create creates a Secret for each of the chunks, starting with the index of
+// the first chunk.
+func (s secretChunks) create(ctx context.Context, migrationName string, first int, chunks [][]byte) error {
+	id := chunkID(migrationName)
+	for i, chunk := range chunks {
+		index := first + i
+		secret := &corev1.Secret{}
+		secret.SetName(fmt.Sprintf("%s%s-%d", s.prefix, id, index))
+		secret.SetNamespace(s.namespace)
+		secret.SetLabels(map[string]string{s.label: id})
+		secret.SetAnnotations(map[string]string{
+			migrationAnnotation: migrationName,
+			chunkAnnotation:     strconv.Itoa(index),
+		})
+		secret.Data = map[string][]byte{chunkKey: chunk}
+		if err := s.kubeClient.Create(ctx, secret); err != nil {
+			return fmt.Errorf("creating %s/%s: %w", s.namespace, secret.GetName(), err)
+		}
+	}
+
+	return nil
+}
+
+// loadChunks returns the items stored for the migration, a NotFound error is
+// returned if there are no Secrets for the migration.
+func loadChunks[T any](ctx context.Context, s secretChunks, migrationName string) ([]T, error) {
+	secrets, err := s.list(ctx, migrationName)
+	if err != nil {
+		return nil, err
+	}
+	if len(secrets) == 0 {
+		return nil, apierrors.NewNotFound(corev1.Resource("secrets"), s.prefix+chunkID(migrationName))
+	}
+
+	var items []T
+	for _, secret := range secrets {
+		var chunk []T
+		if err := json.Unmarshal(secret.Data[chunkKey], &chunk); err != nil {
+			return nil, fmt.Errorf("parsing %s/%s: %w", secret.GetNamespace(), secret.GetName(), err)
+		}
+		items = append(items, chunk...)
+	}
+
+	return items, nil
+}
+
+// delete removes the Secrets for the migration.
+func (s secretChunks) delete(ctx context.Context, migrationName string) error {
+	err := s.kubeClient.DeleteAllOf(ctx, &corev1.Secret{},
+		client.InNamespace(s.namespace), client.MatchingLabels{s.label: chunkID(migrationName)})
+	if err != nil {
+		return fmt.Errorf("deleting %s%s in %s: %w", s.prefix, chunkID(migrationName), s.namespace, err)
+	}
+
+	return nil
+}
+
+// list returns the Secrets for the migration in the order of the chunks.
+func (s secretChunks) list(ctx context.Context, migrationName string) ([]corev1.Secret, error) {
+	var secrets corev1.SecretList
+	err := s.kubeClient.List(ctx, &secrets,
+		client.InNamespace(s.namespace), client.MatchingLabels{s.label: chunkID(migrationName)})
+	if err != nil {
+		return nil, fmt.Errorf("listing %s%s in %s: %w", s.prefix, chunkID(migrationName), s.namespace, err)
+	}
+
+	chunkIndex := func(secret corev1.Secret) int {
+		i, _ := strconv.Atoi(secret.GetAnnotations()[chunkAnnotation])
+		return i
+	}
+	slices.SortFunc(secrets.Items, func(a, b corev1.Secret) int {
+		return cmp.Compare(chunkIndex(a), chunkIndex(b))
+	})
+
+	return secrets.Items, nil
+}
+
+// chunkID returns an identifier for a migration that is valid in the names
+// and labels of Secrets, whatever the characters in the migration name.
+func chunkID(migrationName string) string {
+	sum := sha256.Sum256([]byte(migrationName))
+
+	return hex.EncodeToString(sum[:16])
+}
+
+// splitChunks encodes the items as JSON lists that are each smaller than
+// maxChunkSize.
+func splitChunks[T any](items []T) ([][]byte, error) {
+	var (
+		chunks [][]byte
+		chunk  bytes.Buffer
+	)
+	for _, item := range items {
+		b, err := json.Marshal(&item)
+		if err != nil {
+			return nil, err
+		}
+		if len(b)+2 > maxChunkSize {
+			return nil, fmt.Errorf("an item of %d bytes is too large to store", len(b))
+		}
+
+		if chunk.Len()+len(b)+2 > maxChunkSize {
+			chunk.WriteByte(']')
+			chunks = append(chunks, bytes.Clone(chunk.Bytes()))
+			chunk.Reset()
+		}
+		if chunk.Len() == 0 {
+			chunk.WriteByte('[')
+		} else {
+			chunk.WriteByte(',')
+		}
+		chunk.Write(b)
+	}
+
+	if chunk.Len() == 0 {
+		chunk.WriteByte('[')
+	}
+	chunk.WriteByte(']')
+	chunks = append(chunks, chunk.Bytes())
+
+	return chunks, nil
+}
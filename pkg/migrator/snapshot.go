@@ -0,0 +1,156 @@
+package migrator
+
+import (
+	"context"
+	"fmt"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	snapshotSecretPrefix = "migrator-snapshot-"
+	snapshotLabel        = "migrator.gitops.tools/snapshot"
+)
+
+// SnapshotStore stores the state of resources before they are migrated so that
+// they can be restored later.
+type SnapshotStore interface {
+	// Save stores the original resources for the named migration.
+	Save(ctx context.Context, migrationName string, resources []unstructured.Unstructured) error
+
+	// Load returns the original resources for the named migration.
+	Load(ctx context.Context, migrationName string) ([]unstructured.Unstructured, error)
+
+	// Delete removes the snapshot for the named migration.
+	Delete(ctx context.Context, migrationName string) error
+}
+
+// snapshotAppender is implemented by SnapshotStores that can add resources to
+// an existing snapshot.
+type snapshotAppender interface {
+	Append(ctx context.Context, migrationName string, resources []unstructured.Unstructured) error
+}
+
+// snapshotter saves the resources of a migration to the SnapshotStore a page
+// at a time, before they are patched.
+//
+// The migration has not been applied, but a failed run may have saved and
+// patched some of the resources already, so the resources in an existing
+// snapshot are kept and not saved again.
+//
+// A snapshotter without a store saves nothing.
+type snapshotter struct {
+	store     SnapshotStore
+	migration Migration
+	loaded    bool
+	saved     map[resourceKey]bool
+	// resources are the resources that have been saved, for stores that
+	// cannot add to an existing snapshot.
+	resources []unstructured.Unstructured
+}
+
+func (s *snapshotter) save(ctx context.Context, page []unstructured.Unstructured) error {
+	if s.store == nil {
+		return nil
+	}
+
+	appender, ok := s.store.(snapshotAppender)
+	if !s.loaded {
+		if err := s.load(ctx, !ok); err != nil {
+			return err
+		}
+	}
+
+	var unsaved []unstructured.Unstructured
+	for i := range page {
+		key := keyOf(&page[i])
+		if s.saved[key] {
+			continue
+		}
+		s.saved[key] = true
+		unsaved = append(unsaved, page[i])
+	}
+	if len(unsaved) == 0 {
+		return nil
+	}
+
+	var err error
+	if ok {
+		err = appender.Append(ctx, s.migration.Name, unsaved)
+	} else {
+		s.resources = append(s.resources, unsaved...)
+		err = s.store.Save(ctx, s.migration.Name, s.resources)
+	}
+	if err != nil {
+		return fmt.Errorf("saving snapshot for migration %s: %w", s.migration.Name, err)
+	}
+
+	return nil
+}
+
+// load records the resources in the existing snapshot, keeping them if the
+// store cannot add to it.
+func (s *snapshotter) load(ctx context.Context, keep bool) error {
+	existing, err := s.store.Load(ctx, s.migration.Name)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("loading snapshot for migration %s: %w", s.migration.Name, err)
+	}
+
+	s.saved = map[resourceKey]bool{}
+	for i := range existing {
+		s.saved[keyOf(&existing[i])] = true
+	}
+	if keep {
+		s.resources = existing
+	}
+	s.loaded = true
+
+	return nil
+}
+
+// NewSecretSnapshotStore creates and returns a SnapshotStore that stores each
+// migration's snapshot in Secrets in the provided namespace.
+func NewSecretSnapshotStore(kubeClient client.Client, namespace string) *SecretSnapshotStore {
+	return &SecretSnapshotStore{chunks: secretChunks{
+		kubeClient: kubeClient,
+		namespace:  namespace,
+		prefix:     snapshotSecretPrefix,
+		label:      snapshotLabel,
+	}}
+}
+
+// SecretSnapshotStore is a SnapshotStore that keeps snapshots in Secrets,
+// because the resources being migrated may contain sensitive data.
+//
+// Large snapshots are split across several Secrets, which are named with a
+// hash of the migration name.
+type SecretSnapshotStore struct {
+	chunks secretChunks
+}
+
+// Save implements the SnapshotStore interface.
+func (s *SecretSnapshotStore) Save(ctx context.Context, migrationName string, resources []unstructured.Unstructured) error {
+	return saveChunks(ctx, s.chunks, migrationName, resources)
+}
+
+// Append adds resources to the snapshot for the named migration, so that
+// large migrations can be snapshotted as each page of resources is listed.
+func (s *SecretSnapshotStore) Append(ctx context.Context, migrationName string, resources []unstructured.Unstructured) error {
+	return appendChunks(ctx, s.chunks, migrationName, resources)
+}
+
+// Load implements the SnapshotStore interface.
+func (s *SecretSnapshotStore) Load(ctx context.Context, migrationName string) ([]unstructured.Unstructured, error) {
+	return loadChunks[unstructured.Unstructured](ctx, s.chunks, migrationName)
+}
+
+// Delete implements the SnapshotStore interface.
+func (s *SecretSnapshotStore) Delete(ctx context.Context, migrationName string) error {
+	if err := s.chunks.delete(ctx, migrationName); err != nil {
+		return fmt.Errorf("deleting snapshot for migration %s: %w", migrationName, err)
+	}
+
+	return nil
+}
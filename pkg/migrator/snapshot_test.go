@@ -0,0 +1,149 @@
+package migrator
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+	"sigs.k8s.io/kustomize/v3/pkg/gvk"
+	"sigs.k8s.io/kustomize/v3/pkg/types"
+)
+
+func TestSecretSnapshotStore(t *testing.T) {
+	store := NewSecretSnapshotStore(newFakeClient(), "default")
+	resources := []unstructured.Unstructured{
+		*toUnstructured(t, newService()),
+		*toUnstructured(t, newConfigMap()),
+	}
+
+	assert.NoError(t, store.Save(context.TODO(), "patch-service", resources))
+
+	loaded, err := store.Load(context.TODO(), "patch-service")
+	assert.NoError(t, err)
+	if diff := cmp.Diff(resources, loaded); diff != "" {
+		t.Fatalf("failed to load snapshot:\n%s", diff)
+	}
+
+	// Saving again replaces the existing snapshot.
+	assert.NoError(t, store.Save(context.TODO(), "patch-service", resources[:1]))
+	loaded, err = store.Load(context.TODO(), "patch-service")
+	assert.NoError(t, err)
+	if diff := cmp.Diff(resources[:1], loaded); diff != "" {
+		t.Fatalf("failed to load snapshot:\n%s", diff)
+	}
+
+	assert.NoError(t, store.Delete(context.TODO(), "patch-service"))
+	_, err = store.Load(context.TODO(), "patch-service")
+	assert.True(t, apierrors.IsNotFound(err))
+}
+
+func TestSecretSnapshotStore_large_snapshot(t *testing.T) {
+	fc := newFakeClient()
+	store := NewSecretSnapshotStore(fc, "default")
+	var resources []unstructured.Unstructured
+	for i := 0; i < 5; i++ {
+		resources = append(resources, *toUnstructured(t, newConfigMap(func(cm *corev1.ConfigMap) {
+			cm.SetName(fmt.Sprintf("test-cm-%d", i))
+			cm.Data = map[string]string{"large": strings.Repeat("x", maxChunkSize/3)}
+		})))
+	}
+
+	// The name is not a valid Secret name.
+	assert.NoError(t, store.Save(context.TODO(), "Migrate_ConfigMaps", resources))
+
+	var secrets corev1.SecretList
+	assert.NoError(t, fc.List(context.TODO(), &secrets))
+	assert.Len(t, secrets.Items, 3)
+	for _, secret := range secrets.Items {
+		assert.Equal(t, "Migrate_ConfigMaps", secret.GetAnnotations()[migrationAnnotation])
+		assert.Less(t, len(secret.Data[chunkKey]), maxChunkSize)
+	}
+
+	loaded, err := store.Load(context.TODO(), "Migrate_ConfigMaps")
+	assert.NoError(t, err)
+	if diff := cmp.Diff(resources, loaded); diff != "" {
+		t.Fatalf("failed to load snapshot:\n%s", diff)
+	}
+
+	assert.NoError(t, store.Delete(context.TODO(), "Migrate_ConfigMaps"))
+	assert.NoError(t, fc.List(context.TODO(), &secrets))
+	assert.Empty(t, secrets.Items)
+}
+
+func TestSecretSnapshotStore_resource_too_large(t *testing.T) {
+	store := NewSecretSnapshotStore(newFakeClient(), "default")
+	resources := []unstructured.Unstructured{
+		*toUnstructured(t, newConfigMap(func(cm *corev1.ConfigMap) {
+			cm.Data = map[string]string{"large": strings.Repeat("x", maxChunkSize)}
+		})),
+	}
+
+	err := store.Save(context.TODO(), "patch-configmap", resources)
+	assert.ErrorContains(t, err, "is too large to store")
+}
+
+func TestSecretSnapshotStore_Delete_missing_snapshot(t *testing.T) {
+	store := NewSecretSnapshotStore(newFakeClient(), "default")
+
+	assert.NoError(t, store.Delete(context.TODO(), "patch-service"))
+}
+
+func TestMigrateUp_snapshot_pages(t *testing.T) {
+	migrations := []Migration{
+		{
+			Name: "migrate-configmaps",
+			Target: Target{
+				PatchTarget: types.PatchTarget{
+					Gvk: gvk.Gvk{
+						Version: "v1",
+						Kind:    "ConfigMap",
+					},
+					Namespace: "default",
+				},
+			},
+			Up: []Patch{
+				{
+					Type:   "application/merge-patch+json",
+					Change: `{"data":{"migrated":"true"}}`,
+				},
+			},
+		},
+	}
+
+	var objs []client.Object
+	for i := 0; i < 3; i++ {
+		objs = append(objs, newConfigMap(func(cm *corev1.ConfigMap) {
+			cm.SetName(fmt.Sprintf("test-cm-%d", i))
+		}))
+	}
+	fc := fake.NewClientBuilder().WithObjects(objs...).WithInterceptorFuncs(interceptor.Funcs{
+		List: paginatedList(true, func(client.ListOptions) {}),
+	}).Build()
+	store := NewSecretSnapshotStore(fc, "default")
+
+	if err := MigrateUp(context.TODO(), fc, migrations, WithBatchSize(2), WithSnapshotStore(store)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each page is added to the snapshot before it is patched.
+	var secrets corev1.SecretList
+	assert.NoError(t, fc.List(context.TODO(), &secrets))
+	assert.Len(t, secrets.Items, 2)
+
+	loaded, err := store.Load(context.TODO(), "migrate-configmaps")
+	assert.NoError(t, err)
+	names := collect(loaded, func(u unstructured.Unstructured) string {
+		assert.Empty(t, u.Object["data"].(map[string]any)["migrated"])
+		return u.GetName()
+	})
+	assert.Equal(t, []string{"test-cm-0", "test-cm-1", "test-cm-2"}, names)
+}
@@ -0,0 +1,128 @@
+package migrator
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkjson"
+	"go.starlark.net/syntax"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+const (
+	defaultScriptTimeout = 5 * time.Second
+	starlarkFilename     = "patch.star"
+	starlarkFunction     = "patch"
+	starlarkVarsName     = "vars"
+	starlarkJSONName     = "json"
+)
+
+// WithScriptTimeout configures how long a script can run for when it is
+// applied to a resource, the default is 5 seconds.
+func WithScriptTimeout(d time.Duration) ApplyOption {
+	return func(o *applyOptions) {
+		o.scriptTimeout = d
+	}
+}
+
+// compileStarlark compiles the script of a Starlark patch, and checks that it
+// defines the patch function.
+func compileStarlark(script string) (*starlark.Program, error) {
+	f, prog, err := starlark.SourceProgram(starlarkFilename, script, isStarlarkPredeclared)
+	if err != nil {
+		return nil, fmt.Errorf("compiling script: %w", err)
+	}
+
+	for _, stmt := range f.Stmts {
+		if def, ok := stmt.(*syntax.DefStmt); ok && def.Name.Name == starlarkFunction {
+			return prog, nil
+		}
+	}
+
+	return nil, fmt.Errorf("compiling script: the script must define a %s function", starlarkFunction)
+}
+
+func isStarlarkPredeclared(name string) bool {
+	return name == starlarkVarsName || name == starlarkJSONName
+}
+
+// applyStarlarkPatch calls the patch function of the script with the resource
+// as a dict, and replaces the resource with the dict that is returned.
+//
+// Scripts cannot load modules, and they are cancelled if they run for longer
+// than the script timeout.
+func applyStarlarkPatch(obj *unstructured.Unstructured, p Patch, o *applyOptions) (*unstructured.Unstructured, error) {
+	prog, err := compileStarlark(p.Change)
+	if err != nil {
+		return nil, err
+	}
+
+	thread := &starlark.Thread{
+		Name:  "patch",
+		Print: func(*starlark.Thread, string) {},
+		Load: func(*starlark.Thread, string) (starlark.StringDict, error) {
+			return nil, errors.New("loading modules is not allowed")
+		},
+	}
+	timeout := o.scriptTimeout
+	if timeout == 0 {
+		timeout = defaultScriptTimeout
+	}
+	timer := time.AfterFunc(timeout, func() {
+		thread.Cancel(fmt.Sprintf("timed out after %s", timeout))
+	})
+	defer timer.Stop()
+
+	scriptError := func(err error) error {
+		var evalErr *starlark.EvalError
+		if errors.As(err, &evalErr) {
+			err = errors.New(evalErr.Backtrace())
+		}
+
+		return fmt.Errorf("running script for %s %s: %w", obj.GetKind(), obj.GetName(), err)
+	}
+
+	vars := starlark.NewDict(len(o.vars))
+	for k, v := range o.vars {
+		if err := vars.SetKey(starlark.String(k), starlark.String(v)); err != nil {
+			return nil, err
+		}
+	}
+	vars.Freeze()
+
+	globals, err := prog.Init(thread, starlark.StringDict{
+		starlarkVarsName: vars,
+		starlarkJSONName: starlarkjson.Module,
+	})
+	if err != nil {
+		return nil, scriptError(err)
+	}
+
+	b, err := obj.MarshalJSON()
+	if err != nil {
+		return nil, fmt.Errorf("marshalling resource to JSON for patching: %w", err)
+	}
+	object, err := starlark.Call(thread, starlarkjson.Module.Members["decode"], starlark.Tuple{starlark.String(b)}, nil)
+	if err != nil {
+		return nil, scriptError(err)
+	}
+
+	result, err := starlark.Call(thread, globals[starlarkFunction], starlark.Tuple{object}, nil)
+	if err != nil {
+		return nil, scriptError(err)
+	}
+	if _, ok := result.(*starlark.Dict); !ok {
+		return nil, scriptError(fmt.Errorf("%s must return a dict, got %s", starlarkFunction, result.Type()))
+	}
+
+	encoded, err := starlark.Call(thread, starlarkjson.Module.Members["encode"], starlark.Tuple{result}, nil)
+	if err != nil {
+		return nil, scriptError(err)
+	}
+
+	return applyPatch(obj, func([]byte) ([]byte, error) {
+		return []byte(encoded.(starlark.String).GoString()), nil
+	})
+}
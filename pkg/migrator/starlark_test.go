@@ -0,0 +1,175 @@
+package migrator
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+const ingressScript = `
+def backend(old):
+    port = old["servicePort"]
+    if type(port) == "int":
+        port = {"number": port}
+    else:
+        port = {"name": port}
+    return {"service": {"name": old["serviceName"], "port": port}}
+
+def patch(object):
+    object["apiVersion"] = "networking.k8s.io/v1"
+    for rule in object["spec"].get("rules", []):
+        for path in rule["http"]["paths"]:
+            path["backend"] = backend(path["backend"])
+            path["pathType"] = vars.get("pathType", "ImplementationSpecific")
+    return object
+`
+
+func TestApplyPatches_starlark(t *testing.T) {
+	scriptTests := []struct {
+		name string
+		opts []ApplyOption
+		want []any
+	}{
+		{
+			name: "default path type",
+			want: []any{
+				map[string]any{
+					"path":     "/",
+					"pathType": "ImplementationSpecific",
+					"backend": map[string]any{
+						"service": map[string]any{"name": "web", "port": map[string]any{"number": int64(80)}},
+					},
+				},
+				map[string]any{
+					"path":     "/api",
+					"pathType": "ImplementationSpecific",
+					"backend": map[string]any{
+						"service": map[string]any{"name": "api", "port": map[string]any{"name": "http"}},
+					},
+				},
+			},
+		},
+		{
+			name: "path type from variables",
+			opts: []ApplyOption{WithVariables(map[string]string{"pathType": "Prefix"})},
+			want: []any{
+				map[string]any{
+					"path":     "/",
+					"pathType": "Prefix",
+					"backend": map[string]any{
+						"service": map[string]any{"name": "web", "port": map[string]any{"number": int64(80)}},
+					},
+				},
+				map[string]any{
+					"path":     "/api",
+					"pathType": "Prefix",
+					"backend": map[string]any{
+						"service": map[string]any{"name": "api", "port": map[string]any{"name": "http"}},
+					},
+				},
+			},
+		},
+	}
+
+	for _, tt := range scriptTests {
+		t.Run(tt.name, func(t *testing.T) {
+			patch := Patch{Type: "application/starlark", Change: ingressScript}
+
+			updated, err := ApplyPatches(newIngress(), []Patch{patch}, tt.opts...)
+			assert.NoError(t, err)
+
+			assert.Equal(t, "networking.k8s.io/v1", updated.GetAPIVersion())
+			assert.Equal(t, "test-ingress", updated.GetName())
+			rules, _, err := unstructured.NestedSlice(updated.Object, "spec", "rules")
+			assert.NoError(t, err)
+			if diff := cmp.Diff(tt.want, rules[0].(map[string]any)["http"].(map[string]any)["paths"]); diff != "" {
+				t.Fatalf("failed to apply Starlark patch:\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestApplyPatches_starlark_errors(t *testing.T) {
+	scriptTests := []struct {
+		name    string
+		script  string
+		opts    []ApplyOption
+		wantErr string
+	}{
+		{
+			name:    "invalid script",
+			script:  "def patch(object)\n    return object\n",
+			wantErr: "compiling script: patch.star:2:1: got newline, want ':'",
+		},
+		{
+			name:    "no patch function",
+			script:  "def migrate(object):\n    return object\n",
+			wantErr: "compiling script: the script must define a patch function",
+		},
+		{
+			name:    "not a dict",
+			script:  "def patch(object):\n    return None\n",
+			wantErr: "running script for Ingress test-ingress: patch must return a dict, got NoneType",
+		},
+		{
+			name:    "loading modules",
+			script:  "load(\"os.star\", \"remove\")\ndef patch(object):\n    return object\n",
+			wantErr: "loading modules is not allowed",
+		},
+		{
+			name:    "missing key",
+			script:  "def patch(object):\n    object[\"spec\"][\"tls\"][0][\"hosts\"] = []\n    return object\n",
+			wantErr: `running script for Ingress test-ingress: Traceback (most recent call last):`,
+		},
+		{
+			name:    "timeout",
+			script:  "def patch(object):\n    for i in range(1000000000):\n        pass\n    return object\n",
+			opts:    []ApplyOption{WithScriptTimeout(10 * time.Millisecond)},
+			wantErr: "timed out after 10ms",
+		},
+	}
+
+	for _, tt := range scriptTests {
+		t.Run(tt.name, func(t *testing.T) {
+			patch := Patch{Type: "application/starlark", Change: tt.script}
+
+			_, err := ApplyPatches(newIngress(), []Patch{patch}, tt.opts...)
+			assert.ErrorContains(t, err, tt.wantErr)
+		})
+	}
+}
+
+func newIngress() *unstructured.Unstructured {
+	return &unstructured.Unstructured{
+		Object: map[string]any{
+			"apiVersion": "extensions/v1beta1",
+			"kind":       "Ingress",
+			"metadata": map[string]any{
+				"name":      "test-ingress",
+				"namespace": "default",
+			},
+			"spec": map[string]any{
+				"rules": []any{
+					map[string]any{
+						"host": "example.com",
+						"http": map[string]any{
+							"paths": []any{
+								map[string]any{
+									"path":    "/",
+									"backend": map[string]any{"serviceName": "web", "servicePort": int64(80)},
+								},
+								map[string]any{
+									"path":    "/api",
+									"backend": map[string]any{"serviceName": "api", "servicePort": "http"},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,141 @@
+package migrator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// AppliedMigration is the record of a migration that has been applied.
+type AppliedMigration struct {
+	Name      string    `json:"name"`
+	Checksum  string    `json:"checksum"`
+	AppliedAt time.Time `json:"appliedAt"`
+}
+
+// StateStore records the migrations that have been applied.
+type StateStore interface {
+	// Applied returns the records of all applied migrations.
+	Applied(ctx context.Context) ([]AppliedMigration, error)
+
+	// Record stores the record of an applied migration.
+	Record(ctx context.Context, applied AppliedMigration) error
+
+	// Remove removes the record of the named migration.
+	Remove(ctx context.Context, name string) error
+}
+
+// NewConfigMapStateStore creates and returns a StateStore that stores the
+// records in the ConfigMap identified by key.
+//
+// The ConfigMap is created when the first record is stored.
+func NewConfigMapStateStore(kubeClient client.Client, key client.ObjectKey) *ConfigMapStateStore {
+	return &ConfigMapStateStore{kubeClient: kubeClient, key: key}
+}
+
+// ConfigMapStateStore is a StateStore that keeps one key per migration in a
+// ConfigMap.
+type ConfigMapStateStore struct {
+	kubeClient client.Client
+	key        client.ObjectKey
+}
+
+// Applied implements the StateStore interface.
+func (s *ConfigMapStateStore) Applied(ctx context.Context) ([]AppliedMigration, error) {
+	cm, err := s.configMap(ctx)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	var applied []AppliedMigration
+	for k, v := range cm.Data {
+		var record AppliedMigration
+		if err := json.Unmarshal([]byte(v), &record); err != nil {
+			return nil, fmt.Errorf("parsing state for migration %s in %s: %w", k, s.key, err)
+		}
+		applied = append(applied, record)
+	}
+
+	return applied, nil
+}
+
+// Record implements the StateStore interface.
+func (s *ConfigMapStateStore) Record(ctx context.Context, applied AppliedMigration) error {
+	if errs := validation.IsConfigMapKey(applied.Name); len(errs) > 0 {
+		return fmt.Errorf("invalid migration name %q for state storage: %v", applied.Name, errs)
+	}
+
+	b, err := json.Marshal(applied)
+	if err != nil {
+		return fmt.Errorf("marshalling state for migration %s: %w", applied.Name, err)
+	}
+
+	cm, err := s.configMap(ctx)
+	if err != nil {
+		if !apierrors.IsNotFound(err) {
+			return err
+		}
+
+		cm = &corev1.ConfigMap{}
+		cm.SetName(s.key.Name)
+		cm.SetNamespace(s.key.Namespace)
+		cm.Data = map[string]string{applied.Name: string(b)}
+		if err := s.kubeClient.Create(ctx, cm); err != nil {
+			return fmt.Errorf("creating state %s: %w", s.key, err)
+		}
+
+		return nil
+	}
+
+	if cm.Data == nil {
+		cm.Data = map[string]string{}
+	}
+	cm.Data[applied.Name] = string(b)
+	if err := s.kubeClient.Update(ctx, cm); err != nil {
+		return fmt.Errorf("updating state %s: %w", s.key, err)
+	}
+
+	return nil
+}
+
+// Remove implements the StateStore interface.
+func (s *ConfigMapStateStore) Remove(ctx context.Context, name string) error {
+	cm, err := s.configMap(ctx)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+
+		return err
+	}
+
+	if _, ok := cm.Data[name]; !ok {
+		return nil
+	}
+
+	delete(cm.Data, name)
+	if err := s.kubeClient.Update(ctx, cm); err != nil {
+		return fmt.Errorf("updating state %s: %w", s.key, err)
+	}
+
+	return nil
+}
+
+func (s *ConfigMapStateStore) configMap(ctx context.Context) (*corev1.ConfigMap, error) {
+	var cm corev1.ConfigMap
+	if err := s.kubeClient.Get(ctx, s.key, &cm); err != nil {
+		return nil, fmt.Errorf("getting state %s: %w", s.key, err)
+	}
+
+	return &cm, nil
+}
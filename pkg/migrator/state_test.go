@@ -0,0 +1,74 @@
+package migrator
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var testStateKey = client.ObjectKey{Name: "migrator-state", Namespace: "default"}
+
+func TestConfigMapStateStore(t *testing.T) {
+	fc := newFakeClient()
+	store := NewConfigMapStateStore(fc, testStateKey)
+	appliedAt := time.Date(2024, time.May, 1, 10, 0, 0, 0, time.UTC)
+
+	applied, err := store.Applied(context.TODO())
+	assert.NoError(t, err)
+	assert.Empty(t, applied)
+
+	records := []AppliedMigration{
+		{Name: "migration-1", Checksum: "abc123", AppliedAt: appliedAt},
+		{Name: "migration-2", Checksum: "def456", AppliedAt: appliedAt},
+	}
+	for _, record := range records {
+		assert.NoError(t, store.Record(context.TODO(), record))
+	}
+
+	applied, err = store.Applied(context.TODO())
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, records, applied)
+
+	assert.NoError(t, store.Remove(context.TODO(), "migration-1"))
+
+	applied, err = store.Applied(context.TODO())
+	assert.NoError(t, err)
+	if diff := cmp.Diff(records[1:], applied); diff != "" {
+		t.Fatalf("failed to remove record:\n%s", diff)
+	}
+}
+
+func TestConfigMapStateStore_Remove_missing_configmap(t *testing.T) {
+	store := NewConfigMapStateStore(newFakeClient(), testStateKey)
+
+	assert.NoError(t, store.Remove(context.TODO(), "migration-1"))
+}
+
+func TestConfigMapStateStore_Record_invalid_name(t *testing.T) {
+	store := NewConfigMapStateStore(newFakeClient(), testStateKey)
+
+	err := store.Record(context.TODO(), AppliedMigration{Name: "bad name"})
+	assert.ErrorContains(t, err, `invalid migration name "bad name" for state storage`)
+}
+
+func TestConfigMapStateStore_Applied_bad_state(t *testing.T) {
+	fc := newFakeClient(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      testStateKey.Name,
+			Namespace: testStateKey.Namespace,
+		},
+		Data: map[string]string{
+			"migration-1": "not-json",
+		},
+	})
+	store := NewConfigMapStateStore(fc, testStateKey)
+
+	_, err := store.Applied(context.TODO())
+	assert.ErrorContains(t, err, "parsing state for migration migration-1 in default/migrator-state")
+}
@@ -0,0 +1,97 @@
+package migrator
+
+import (
+	"fmt"
+	"regexp"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// targetSelector is the parsed form of the selectors in a Target.
+//
+// A nil field matches all resources.
+type targetSelector struct {
+	name        *regexp.Regexp
+	namespace   *regexp.Regexp
+	labels      labels.Selector
+	annotations labels.Selector
+}
+
+func (t Target) selector() (*targetSelector, error) {
+	var s targetSelector
+	if t.Name != "" {
+		re, err := compileTargetRegexp(t.Name)
+		if err != nil {
+			return nil, fmt.Errorf("parsing name %q: %w", t.Name, err)
+		}
+		s.name = re
+	}
+
+	if t.Namespace != "" {
+		re, err := compileTargetRegexp(t.Namespace)
+		if err != nil {
+			return nil, fmt.Errorf("parsing namespace %q: %w", t.Namespace, err)
+		}
+		s.namespace = re
+	}
+
+	if t.LabelSelector != "" {
+		selector, err := labels.Parse(t.LabelSelector)
+		if err != nil {
+			return nil, fmt.Errorf("parsing label selector %q: %w", t.LabelSelector, err)
+		}
+		s.labels = selector
+	}
+
+	if t.AnnotationSelector != "" {
+		selector, err := labels.Parse(t.AnnotationSelector)
+		if err != nil {
+			return nil, fmt.Errorf("parsing annotation selector %q: %w", t.AnnotationSelector, err)
+		}
+		s.annotations = selector
+	}
+
+	return &s, nil
+}
+
+// matches returns true if the resource matches all the selectors.
+func (s *targetSelector) matches(u *unstructured.Unstructured) bool {
+	if s.name != nil && !s.name.MatchString(u.GetName()) {
+		return false
+	}
+
+	if s.namespace != nil && !s.namespace.MatchString(u.GetNamespace()) {
+		return false
+	}
+
+	if s.labels != nil && !s.labels.Matches(labels.Set(u.GetLabels())) {
+		return false
+	}
+
+	return s.annotations == nil || s.annotations.Matches(labels.Set(u.GetAnnotations()))
+}
+
+// matchesGroupVersionKind returns true if the resource has the
+// GroupVersionKind of the Target of the migration.
+func matchesGroupVersionKind(u *unstructured.Unstructured, migration Migration) bool {
+	return u.GroupVersionKind() == migration.TargetGroupVersionKind()
+}
+
+// compileTargetRegexp compiles a name or namespace as a regular expression that
+// must match the whole value.
+func compileTargetRegexp(s string) (*regexp.Regexp, error) {
+	return regexp.Compile("^(?:" + s + ")$")
+}
+
+// isLiteralName returns true if the name can only match a single resource name.
+func isLiteralName(s string) bool {
+	return len(validation.IsDNS1123Subdomain(s)) == 0
+}
+
+// isLiteralNamespace returns true if the namespace can only match a single
+// namespace.
+func isLiteralNamespace(s string) bool {
+	return len(validation.IsDNS1123Label(s)) == 0
+}
@@ -0,0 +1,85 @@
+package migrator
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"text/template"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// templateData is the data available to templated patches.
+type templateData struct {
+	Object    map[string]any
+	Name      string
+	Namespace string
+	Vars      map[string]string
+}
+
+var templateFuncs = template.FuncMap{
+	"toJson": func(v any) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// WithVariables configures the variables that are available to templated
+// patches as .Vars.
+func WithVariables(vars map[string]string) ApplyOption {
+	return func(o *applyOptions) {
+		o.vars = vars
+	}
+}
+
+// renderPatch renders the change of a templated patch for a resource.
+//
+// The rendered patch has the change as a string, structured changes are
+// rendered as JSON.
+func renderPatch(p Patch, obj *unstructured.Unstructured, vars map[string]string) (Patch, error) {
+	change, err := patchSource(p)
+	if err != nil {
+		return Patch{}, err
+	}
+
+	tmpl, err := template.New("patch").Option("missingkey=error").Funcs(templateFuncs).Parse(change)
+	if err != nil {
+		return Patch{}, fmt.Errorf("parsing patch template: %w", err)
+	}
+
+	if vars == nil {
+		vars = map[string]string{}
+	}
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, templateData{
+		Object:    obj.Object,
+		Name:      obj.GetName(),
+		Namespace: obj.GetNamespace(),
+		Vars:      vars,
+	}); err != nil {
+		return Patch{}, fmt.Errorf("rendering patch template for %s %s: %w", obj.GetKind(), obj.GetName(), err)
+	}
+
+	return Patch{Type: p.Type, Change: b.String()}, nil
+}
+
+// patchSource returns the change of a patch as a string, structured changes
+// are encoded as JSON.
+func patchSource(p Patch) (string, error) {
+	var structured any
+	switch {
+	case p.Operations != nil:
+		structured = p.Operations
+	case p.Merge != nil:
+		structured = p.Merge
+	default:
+		return p.Change, nil
+	}
+
+	b, err := json.Marshal(structured)
+	if err != nil {
+		return "", fmt.Errorf("encoding patch template: %w", err)
+	}
+
+	return string(b), nil
+}
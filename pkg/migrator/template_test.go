@@ -0,0 +1,133 @@
+package migrator
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestApplyPatches_templates(t *testing.T) {
+	templateTests := []struct {
+		name  string
+		patch Patch
+		opts  []ApplyOption
+		want  *corev1.Service
+	}{
+		{
+			name: "annotation from the name",
+			patch: Patch{
+				Type:     "application/merge-patch+json",
+				Template: true,
+				Change:   `{"metadata":{"annotations":{"example.com/name":"{{ .Namespace }}/{{ .Name }}"}}}`,
+			},
+			want: newService(
+				withLabels(map[string]string{"app": "test"}),
+				withAnnotations(map[string]string{"example.com/name": "default/test-svc"})),
+		},
+		{
+			name: "selector from a label",
+			patch: Patch{
+				Type:     "application/json-patch+json",
+				Template: true,
+				Operations: []Operation{
+					{Op: "add", Path: "/spec/selector", Value: []byte(`{"app":"{{ .Object.metadata.labels.app }}"}`)},
+				},
+			},
+			want: newService(
+				withLabels(map[string]string{"app": "test"}),
+				func(svc *corev1.Service) { svc.Spec.Selector = map[string]string{"app": "test"} }),
+		},
+		{
+			name: "labels from variables",
+			patch: Patch{
+				Type:     "application/merge-patch+json",
+				Template: true,
+				Merge: map[string]any{
+					"metadata": map[string]any{
+						"labels": map[string]any{"env": "{{ .Vars.env }}"},
+					},
+				},
+			},
+			opts: []ApplyOption{WithVariables(map[string]string{"env": "production"})},
+			want: newService(withLabels(map[string]string{"app": "test", "env": "production"})),
+		},
+		{
+			name: "JSON values",
+			patch: Patch{
+				Type:     "application/merge-patch+json",
+				Template: true,
+				Change:   `{"spec":{"selector":{{ toJson .Object.metadata.labels }}}}`,
+			},
+			want: newService(
+				withLabels(map[string]string{"app": "test"}),
+				func(svc *corev1.Service) { svc.Spec.Selector = map[string]string{"app": "test"} }),
+		},
+		{
+			name: "not templated",
+			patch: Patch{
+				Type:   "application/merge-patch+json",
+				Change: `{"metadata":{"annotations":{"example.com/name":"{{ .Name }}"}}}`,
+			},
+			want: newService(
+				withLabels(map[string]string{"app": "test"}),
+				withAnnotations(map[string]string{"example.com/name": "{{ .Name }}"})),
+		},
+	}
+
+	for _, tt := range templateTests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := toUnstructured(t, newService(withLabels(map[string]string{"app": "test"})))
+
+			updated, err := ApplyPatches(svc, []Patch{tt.patch}, tt.opts...)
+			assert.NoError(t, err)
+
+			var got corev1.Service
+			assert.NoError(t, runtime.DefaultUnstructuredConverter.FromUnstructured(updated.Object, &got))
+			if diff := cmp.Diff(tt.want, &got); diff != "" {
+				t.Fatalf("failed to apply templated patch:\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestApplyPatches_template_errors(t *testing.T) {
+	templateTests := []struct {
+		name    string
+		change  string
+		wantErr string
+	}{
+		{
+			name:    "undefined variable",
+			change:  `{"metadata":{"labels":{"env":"{{ .Vars.env }}"}}}`,
+			wantErr: `rendering patch template for Service test-svc: template: patch:1:38: executing "patch" at <.Vars.env>: map has no entry for key "env"`,
+		},
+		{
+			name:    "undefined field",
+			change:  `{"metadata":{"labels":{"tier":"{{ .Object.metadata.labels.tier }}"}}}`,
+			wantErr: `map has no entry for key "labels"`,
+		},
+		{
+			name:    "invalid template",
+			change:  `{"metadata":{"labels":{"env":"{{ .Vars.env "}}}`,
+			wantErr: "parsing patch template",
+		},
+	}
+
+	for _, tt := range templateTests {
+		t.Run(tt.name, func(t *testing.T) {
+			patches := []Patch{
+				{
+					Type:     "application/merge-patch+json",
+					Template: true,
+					Change:   tt.change,
+				},
+			}
+
+			_, err := ApplyPatches(toUnstructured(t, newService()), patches)
+			assert.ErrorContains(t, err, tt.wantErr)
+		})
+	}
+}
@@ -0,0 +1,366 @@
+package migrator
+
+import (
+	"cmp"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template"
+
+	jsonpatch "github.com/evanphx/json-patch/v5"
+	apitypes "k8s.io/apimachinery/pkg/types"
+	openapierrors "k8s.io/kube-openapi/pkg/validation/errors"
+	"k8s.io/kube-openapi/pkg/validation/spec"
+	"k8s.io/kube-openapi/pkg/validation/strfmt"
+	"k8s.io/kube-openapi/pkg/validation/validate"
+	kyaml "sigs.k8s.io/kustomize/kyaml/yaml"
+	"sigs.k8s.io/yaml"
+)
+
+// MigrationSchema is the JSON Schema for migration files.
+//
+//go:embed migration.schema.json
+var MigrationSchema []byte
+
+var yamlErrorLine = regexp.MustCompile(`line (\d+)`)
+
+// ValidationError is a problem found in a migration file.
+type ValidationError struct {
+	Filename string
+	Line     int
+	Field    string
+	Message  string
+}
+
+func (e ValidationError) Error() string {
+	location := e.Filename
+	if e.Line > 0 {
+		location = fmt.Sprintf("%s:%d", e.Filename, e.Line)
+	}
+	if e.Field == "" {
+		return fmt.Sprintf("%s: %s", location, e.Message)
+	}
+
+	return fmt.Sprintf("%s: %s: %s", location, e.Field, e.Message)
+}
+
+// ValidationErrors is returned by ValidateDirectory with all the problems
+// found in the migration files.
+type ValidationErrors []ValidationError
+
+func (e ValidationErrors) Error() string {
+	lines := make([]string, len(e))
+	for i, err := range e {
+		lines[i] = err.Error()
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// ValidateDirectory validates all the migration files in a directory against
+// the MigrationSchema, and checks that the changes of the patches can be
+// decoded.
+//
+// All the problems that are found are returned as ValidationErrors.
+func ValidateDirectory(dir string) error {
+	schema, err := migrationSchema()
+	if err != nil {
+		return err
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("reading directory %s: %w", dir, err)
+	}
+
+	var errs ValidationErrors
+	for _, name := range filterYAMLFiles(files) {
+		errs = append(errs, validateFile(schema, filepath.Join(dir, name))...)
+	}
+
+	// The versions and names are checked across all the files.
+	if len(errs) == 0 {
+		if _, err := ParseDirectory(dir); err != nil {
+			errs = append(errs, ValidationError{Filename: dir, Message: err.Error()})
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+
+	return nil
+}
+
+func migrationSchema() (*spec.Schema, error) {
+	var schema spec.Schema
+	if err := json.Unmarshal(MigrationSchema, &schema); err != nil {
+		return nil, fmt.Errorf("parsing migration schema: %w", err)
+	}
+
+	return &schema, nil
+}
+
+func validateFile(schema *spec.Schema, filename string) ValidationErrors {
+	fileError := func(line int, field, message string) ValidationError {
+		return ValidationError{Filename: filename, Line: line, Field: field, Message: message}
+	}
+
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return ValidationErrors{fileError(0, "", err.Error())}
+	}
+
+	node, err := kyaml.Parse(string(b))
+	if err != nil {
+		return ValidationErrors{fileError(yamlLine(err), "", err.Error())}
+	}
+
+	j, err := yaml.YAMLToJSON(b)
+	if err != nil {
+		return ValidationErrors{fileError(yamlLine(err), "", err.Error())}
+	}
+	var doc any
+	if err := json.Unmarshal(j, &doc); err != nil {
+		return ValidationErrors{fileError(0, "", err.Error())}
+	}
+
+	var errs ValidationErrors
+	result := validate.NewSchemaValidator(schema, nil, "", strfmt.Default).Validate(doc)
+	for _, err := range result.Errors {
+		field, message := schemaError(err)
+		if isAnyOfError(err) {
+			message = anyOfMessage(schema)
+		}
+		errs = append(errs, fileError(fieldLine(node.YNode(), field), field, message))
+	}
+
+	root, _ := doc.(map[string]any)
+	for _, direction := range []string{"up", "down"} {
+		patches, _ := root[direction].([]any)
+		for i, v := range patches {
+			patch, _ := v.(map[string]any)
+			field := fmt.Sprintf("%s[%d].change", direction, i)
+			if path, ok := patch["path"].(string); ok {
+				field = fmt.Sprintf("%s[%d].path", direction, i)
+				if err := readChange(filepath.Dir(filename), path, patch); err != nil {
+					errs = append(errs, fileError(fieldLine(node.YNode(), field), field, err.Error()))
+					continue
+				}
+			}
+			if err := validateChange(patch); err != nil {
+				errs = append(errs, fileError(fieldLine(node.YNode(), field), field, err.Error()))
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		slices.SortStableFunc(errs, func(a, b ValidationError) int {
+			return cmp.Compare(a.Line, b.Line)
+		})
+
+		return errs
+	}
+
+	// The parts of the migration that the schema cannot check.
+	migration, err := readYAML(filename)
+	if err != nil {
+		return ValidationErrors{fileError(0, "", err.Error())}
+	}
+	if _, err := migration.Target.selector(); err != nil {
+		return ValidationErrors{fileError(fieldLine(node.YNode(), "target"), "target", err.Error())}
+	}
+
+	return nil
+}
+
+// schemaError returns the field and the message for an error from validating
+// against the schema.
+func schemaError(err error) (string, string) {
+	var validationErr *openapierrors.Validation
+	if !errors.As(err, &validationErr) {
+		return "", err.Error()
+	}
+
+	field := validationErr.Name
+	if key, ok := validationErr.Value.(string); ok && validationErr.Code() == openapierrors.UnallowedPropertyCode {
+		field = strings.TrimPrefix(field+"."+key, ".")
+	}
+
+	return field, strings.TrimPrefix(err.Error(), field+" in body ")
+}
+
+// isAnyOfError returns true if the error is that a document matches none of
+// the anyOf schemas.
+func isAnyOfError(err error) bool {
+	var compositeErr openapierrors.Error
+	return errors.As(err, &compositeErr) && compositeErr.Code() == openapierrors.CompositeErrorCode &&
+		strings.HasSuffix(err.Error(), "must validate at least one schema (anyOf)")
+}
+
+// anyOfMessage returns the descriptions of the anyOf schemas of the migration,
+// which explain the rule that is broken better than the error.
+func anyOfMessage(schema *spec.Schema) string {
+	var descriptions []string
+	for _, s := range schema.AnyOf {
+		if s.Description != "" {
+			descriptions = append(descriptions, s.Description)
+		}
+	}
+
+	return strings.Join(descriptions, ", ")
+}
+
+// readChange reads the change of a patch from a patch file so that it can be
+// validated.
+func readChange(dir, path string, patch map[string]any) error {
+	patchType, _ := patch["type"].(string)
+	template, _ := patch["template"].(bool)
+	b, err := readPatchFile(dir, path, apitypes.PatchType(patchType), template)
+	if err != nil {
+		return err
+	}
+
+	var raw struct {
+		Change any `json:"change"`
+	}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	patch["change"] = raw.Change
+
+	return nil
+}
+
+// validateChange checks that the change of a patch can be decoded for the
+// type of the patch.
+func validateChange(patch map[string]any) error {
+	change, ok := patch["change"]
+	if !ok {
+		return nil
+	}
+
+	// Templated changes can only be decoded once they are rendered.
+	if patch["template"] == true {
+		source, ok := change.(string)
+		if !ok {
+			b, err := json.Marshal(change)
+			if err != nil {
+				return err
+			}
+			source = string(b)
+		}
+		if _, err := template.New("patch").Funcs(templateFuncs).Parse(source); err != nil {
+			return fmt.Errorf("parsing patch template: %w", err)
+		}
+
+		return nil
+	}
+
+	s, isString := change.(string)
+	switch patch["type"] {
+	case jsonPatchType:
+		b := []byte(s)
+		if !isString {
+			var err error
+			if b, err = json.Marshal(change); err != nil {
+				return err
+			}
+		}
+		if _, err := jsonpatch.DecodePatch(b); err != nil {
+			return fmt.Errorf("decoding JSON patch: %w", err)
+		}
+	case mergePatchType, strategicMergePatchType:
+		if isString {
+			var obj map[string]any
+			if err := json.Unmarshal([]byte(s), &obj); err != nil {
+				return fmt.Errorf("decoding merge patch: %w", err)
+			}
+		} else if _, ok := change.(map[string]any); !ok {
+			return errors.New("a merge patch must be an object")
+		}
+	case applyPatchType:
+		if isString {
+			var obj map[string]any
+			if err := yaml.Unmarshal([]byte(s), &obj); err != nil {
+				return fmt.Errorf("decoding apply patch: %w", err)
+			}
+		} else if _, ok := change.(map[string]any); !ok {
+			return errors.New("an apply patch must be an object")
+		}
+	case celPatchType:
+		if !isString {
+			return errors.New("a CEL patch must be an expression")
+		}
+		if _, err := compileCEL(s); err != nil {
+			return err
+		}
+	case starlarkPatchType:
+		if !isString {
+			return errors.New("a Starlark patch must be a script")
+		}
+		if _, err := compileStarlark(s); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// fieldLine returns the line of the field identified by a path e.g.
+// up[0].type, or the line of the closest parent that is found.
+func fieldLine(node *kyaml.Node, path string) int {
+	if node.Kind == kyaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+
+	line := node.Line
+	if path == "" {
+		return line
+	}
+
+	path = strings.NewReplacer("[", ".", "]", "").Replace(path)
+	for _, part := range strings.Split(path, ".") {
+		switch node.Kind {
+		case kyaml.MappingNode:
+			found := false
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				if node.Content[i].Value == part {
+					line, node, found = node.Content[i].Line, node.Content[i+1], true
+					break
+				}
+			}
+			if !found {
+				return line
+			}
+		case kyaml.SequenceNode:
+			i, err := strconv.Atoi(part)
+			if err != nil || i >= len(node.Content) {
+				return line
+			}
+			node = node.Content[i]
+			line = node.Line
+		default:
+			return line
+		}
+	}
+
+	return line
+}
+
+func yamlLine(err error) int {
+	match := yamlErrorLine.FindStringSubmatch(err.Error())
+	if match == nil {
+		return 0
+	}
+	line, _ := strconv.Atoi(match[1])
+
+	return line
+}
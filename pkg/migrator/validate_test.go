@@ -0,0 +1,99 @@
+package migrator
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateDirectory(t *testing.T) {
+	for _, dir := range []string{"testdata/simple", "testdata/structured", "testdata/versioned", "testdata/preconditions", "testdata/verify", "testdata/cel", "testdata/starlark", "testdata/patch_files", "../../example/migrations"} {
+		t.Run(dir, func(t *testing.T) {
+			assert.NoError(t, ValidateDirectory(dir))
+		})
+	}
+}
+
+func TestValidateDirectory_errors(t *testing.T) {
+	err := ValidateDirectory("testdata/invalid")
+
+	var validationErrs ValidationErrors
+	assert.ErrorAs(t, err, &validationErrs)
+	want := ValidationErrors{
+		{
+			Filename: "testdata/invalid/1_typos.yaml",
+			Line:     4,
+			Field:    "target.kind",
+			Message:  "should match '^[A-Z][A-Za-z0-9]*$'",
+		},
+		{
+			Filename: "testdata/invalid/1_typos.yaml",
+			Line:     6,
+			Field:    "up[0].tpye",
+			Message:  "is a forbidden property",
+		},
+		{
+			Filename: "testdata/invalid/1_typos.yaml",
+			Line:     6,
+			Field:    "up[0].type",
+			Message:  "is required",
+		},
+		{
+			Filename: "testdata/invalid/1_typos.yaml",
+			Line:     9,
+			Field:    "up[1].change",
+			Message:  "decoding merge patch: unexpected end of JSON input",
+		},
+		{
+			Filename: "testdata/invalid/1_typos.yaml",
+			Line:     11,
+			Field:    "down[0].type",
+			Message:  "should be one of [application/json-patch+json application/merge-patch+json application/strategic-merge-patch+json application/apply-patch+yaml application/cel application/starlark]",
+		},
+		{
+			Filename: "testdata/invalid/2_selector.yaml",
+			Line:     2,
+			Field:    "target",
+			Message:  `parsing label selector "app in (": unable to parse requirement: found '', expected: ',', ')' or identifier`,
+		},
+	}
+	if diff := cmp.Diff(want, validationErrs); diff != "" {
+		t.Fatalf("failed to validate:\n%s", diff)
+	}
+	assert.ErrorContains(t, err, "testdata/invalid/1_typos.yaml:6: up[0].tpye: is a forbidden property\n")
+}
+
+func TestValidateDirectory_invalid_cel(t *testing.T) {
+	err := ValidateDirectory("testdata/invalid_cel")
+
+	assert.ErrorContains(t, err, "testdata/invalid_cel/1_cel.yaml:7: up[0].change: compiling CEL expression: ERROR: <input>:1:51: Syntax error")
+}
+
+func TestValidateDirectory_missing_patch_file(t *testing.T) {
+	err := ValidateDirectory("testdata/patch_files_invalid")
+
+	assert.EqualError(t, err, "testdata/patch_files_invalid/1_missing.yaml:7: up[0].path: reading patch file: open testdata/patch_files_invalid/patches/missing.yaml: no such file or directory")
+}
+
+func TestValidateDirectory_invalid_yaml(t *testing.T) {
+	err := ValidateDirectory("testdata/bad_yaml")
+
+	var validationErrs ValidationErrors
+	assert.ErrorAs(t, err, &validationErrs)
+	assert.Len(t, validationErrs, 1)
+	assert.NotZero(t, validationErrs[0].Line)
+}
+
+func TestValidateDirectory_rollback_without_down(t *testing.T) {
+	err := ValidateDirectory("testdata/rollback_without_down")
+
+	assert.EqualError(t, err, "testdata/rollback_without_down/1_update_image.yaml:1: verify.rollbackOnFailure requires down patches\n"+
+		"testdata/rollback_without_down/1_update_image.yaml:18: verify.rollbackOnFailure: should be one of [false]")
+}
+
+func TestValidateDirectory_invalid_name(t *testing.T) {
+	err := ValidateDirectory("testdata/invalid_name")
+
+	assert.EqualError(t, err, "testdata/invalid_name/1_add_item.yaml:1: name: should match '^[-._a-zA-Z0-9]+$'")
+}
@@ -0,0 +1,154 @@
+package migrator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	defaultVerifyTimeout  = 5 * time.Minute
+	defaultVerifyInterval = 5 * time.Second
+)
+
+// Verification describes the checks that must pass for the migrated resources
+// after a migration is applied, e.g. that a Deployment has rolled out.
+//
+// The checks are polled until they pass or the Timeout is reached, if they do
+// not pass the migration fails, and if RollbackOnFailure is set, the Down
+// patches are applied to the resources.
+type Verification struct {
+	Conditions         []ConditionCheck `json:"conditions,omitempty"`
+	ObservedGeneration bool             `json:"observedGeneration,omitempty"`
+	Fields             []FieldCondition `json:"fields,omitempty"`
+	Timeout            metav1.Duration  `json:"timeout,omitempty"`
+	Interval           metav1.Duration  `json:"interval,omitempty"`
+	RollbackOnFailure  bool             `json:"rollbackOnFailure,omitempty"`
+}
+
+// ConditionCheck checks the status of a condition in status.conditions.
+type ConditionCheck struct {
+	Type   string `json:"type"`
+	Status string `json:"status"`
+}
+
+// validate checks that the JSONPath expressions can be parsed, and that there
+// are down patches to roll back with if RollbackOnFailure is set.
+func (v *Verification) validate(down []Patch) error {
+	if v == nil {
+		return nil
+	}
+
+	if v.RollbackOnFailure && len(down) == 0 {
+		return errors.New("verify.rollbackOnFailure requires down patches")
+	}
+
+	for _, field := range v.Fields {
+		if _, err := parseJSONPath(field.Path); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// check returns the reason that the resource fails the verification, or an
+// empty string if it passes.
+func (v *Verification) check(u *unstructured.Unstructured) (string, error) {
+	for _, condition := range v.Conditions {
+		if reason := condition.check(u); reason != "" {
+			return reason, nil
+		}
+	}
+
+	if v.ObservedGeneration {
+		observed, found, err := unstructured.NestedInt64(u.Object, "status", "observedGeneration")
+		if err != nil || !found {
+			return "status.observedGeneration is missing", nil
+		}
+		if observed < u.GetGeneration() {
+			return fmt.Sprintf("observedGeneration %d is less than generation %d", observed, u.GetGeneration()), nil
+		}
+	}
+
+	for _, field := range v.Fields {
+		reason, err := field.check(u)
+		if err != nil || reason != "" {
+			return reason, err
+		}
+	}
+
+	return "", nil
+}
+
+func (c ConditionCheck) check(u *unstructured.Unstructured) string {
+	conditions, _, _ := unstructured.NestedSlice(u.Object, "status", "conditions")
+	for _, v := range conditions {
+		condition, ok := v.(map[string]any)
+		if !ok || condition["type"] != c.Type {
+			continue
+		}
+
+		if condition["status"] != c.Status {
+			return fmt.Sprintf("condition %s is %v not %s", c.Type, condition["status"], c.Status)
+		}
+
+		return ""
+	}
+
+	return fmt.Sprintf("condition %s is missing", c.Type)
+}
+
+// verifyResources polls the migrated resources until they pass the
+// verification of the migration.
+func verifyResources(ctx context.Context, kubeClient client.Reader, migration Migration, resources []unstructured.Unstructured) error {
+	v := migration.Verify
+	timeout, interval := v.Timeout.Duration, v.Interval.Duration
+	if timeout == 0 {
+		timeout = defaultVerifyTimeout
+	}
+	if interval == 0 {
+		interval = defaultVerifyInterval
+	}
+
+	remaining := resources
+	var reason string
+	err := wait.PollUntilContextTimeout(ctx, interval, timeout, true, func(ctx context.Context) (bool, error) {
+		var failing []unstructured.Unstructured
+		for _, resource := range remaining {
+			current, err := refetchResource(ctx, kubeClient, &resource)
+			if err != nil {
+				return false, err
+			}
+
+			r, err := v.check(current)
+			if err != nil {
+				return false, err
+			}
+			if r != "" {
+				if len(failing) == 0 {
+					reason = fmt.Sprintf("%s %s: %s", resource.GetKind(), client.ObjectKeyFromObject(&resource), r)
+				}
+				failing = append(failing, resource)
+			}
+		}
+		remaining = failing
+
+		return len(remaining) == 0, nil
+	})
+	if err != nil {
+		if wait.Interrupted(err) && reason != "" {
+			err = errors.New(reason)
+		}
+
+		return fmt.Errorf("verifying migration %s: %w", migration.Name, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,209 @@
+package migrator
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/kustomize/v3/pkg/gvk"
+	"sigs.k8s.io/kustomize/v3/pkg/types"
+)
+
+func TestVerification_check(t *testing.T) {
+	deployment := toUnstructured(t, newDeployment(withAvailable(corev1.ConditionTrue)))
+
+	checkTests := []struct {
+		name   string
+		verify *Verification
+		want   string
+	}{
+		{
+			name:   "condition has status",
+			verify: &Verification{Conditions: []ConditionCheck{{Type: "Available", Status: "True"}}},
+		},
+		{
+			name:   "condition has a different status",
+			verify: &Verification{Conditions: []ConditionCheck{{Type: "Available", Status: "False"}}},
+			want:   "condition Available is True not False",
+		},
+		{
+			name:   "condition is missing",
+			verify: &Verification{Conditions: []ConditionCheck{{Type: "Progressing", Status: "True"}}},
+			want:   "condition Progressing is missing",
+		},
+		{
+			name:   "observed generation",
+			verify: &Verification{ObservedGeneration: true},
+		},
+		{
+			name:   "field equals",
+			verify: &Verification{Fields: []FieldCondition{{Path: "{.status.readyReplicas}", Equals: ptr("1")}}},
+		},
+		{
+			name:   "field does not equal",
+			verify: &Verification{Fields: []FieldCondition{{Path: "{.status.readyReplicas}", Equals: ptr("3")}}},
+			want:   `field {.status.readyReplicas} is "1" not "3"`,
+		},
+	}
+
+	for _, tt := range checkTests {
+		t.Run(tt.name, func(t *testing.T) {
+			reason, err := tt.verify.check(deployment)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, reason)
+		})
+	}
+
+	t.Run("observed generation is behind", func(t *testing.T) {
+		deployment := toUnstructured(t, newDeployment(withAvailable(corev1.ConditionTrue)))
+		deployment.SetGeneration(3)
+
+		reason, err := (&Verification{ObservedGeneration: true}).check(deployment)
+		assert.NoError(t, err)
+		assert.Equal(t, "observedGeneration 2 is less than generation 3", reason)
+	})
+}
+
+func TestMigrateUp_verify(t *testing.T) {
+	verifyMigrations := func(rollback bool) []Migration {
+		return []Migration{
+			{
+				Name: "update-image",
+				Target: Target{
+					PatchTarget: types.PatchTarget{
+						Gvk: gvk.Gvk{
+							Group:   "apps",
+							Version: "v1",
+							Kind:    "Deployment",
+						},
+						Namespace: "default",
+						Name:      "test-deployment",
+					},
+				},
+				Up: []Patch{
+					{
+						Type:   "application/json-patch+json",
+						Change: `[{"op":"replace","path":"/spec/template/spec/containers/0/image","value":"app:v2"}]`,
+					},
+				},
+				Down: []Patch{
+					{
+						Type:   "application/json-patch+json",
+						Change: `[{"op":"replace","path":"/spec/template/spec/containers/0/image","value":"app:v1"}]`,
+					},
+				},
+				Verify: &Verification{
+					Conditions:         []ConditionCheck{{Type: "Available", Status: "True"}},
+					ObservedGeneration: true,
+					Timeout:            metav1.Duration{Duration: 50 * time.Millisecond},
+					Interval:           metav1.Duration{Duration: 10 * time.Millisecond},
+					RollbackOnFailure:  rollback,
+				},
+			},
+		}
+	}
+
+	verifyTests := []struct {
+		name      string
+		available corev1.ConditionStatus
+		rollback  bool
+		wantErr   string
+		wantImage string
+	}{
+		{
+			name:      "verification passes",
+			available: corev1.ConditionTrue,
+			wantImage: "app:v2",
+		},
+		{
+			name:      "verification fails",
+			available: corev1.ConditionFalse,
+			wantErr:   "verifying migration update-image: Deployment default/test-deployment: condition Available is False not True",
+			wantImage: "app:v2",
+		},
+		{
+			name:      "verification fails with rollback",
+			available: corev1.ConditionFalse,
+			rollback:  true,
+			wantErr:   "verifying migration update-image: Deployment default/test-deployment: condition Available is False not True",
+			wantImage: "app:v1",
+		},
+	}
+
+	for _, tt := range verifyTests {
+		t.Run(tt.name, func(t *testing.T) {
+			fc := fake.NewClientBuilder().WithObjects(newDeployment(withAvailable(tt.available))).Build()
+			store := NewConfigMapStateStore(fc, client.ObjectKey{Name: "migrator-state", Namespace: "default"})
+
+			err := MigrateUp(context.TODO(), fc, verifyMigrations(tt.rollback), WithStateStore(store))
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+			}
+
+			var deployment appsv1.Deployment
+			if err := fc.Get(context.TODO(), client.ObjectKey{Name: "test-deployment", Namespace: "default"}, &deployment); err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tt.wantImage, deployment.Spec.Template.Spec.Containers[0].Image)
+
+			applied, err := store.Applied(context.TODO())
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tt.wantErr == "", len(applied) == 1)
+		})
+	}
+}
+
+func TestMigrateUp_verify_rollback_without_down(t *testing.T) {
+	migrations := []Migration{
+		{
+			Name: "update-image",
+			Target: Target{
+				PatchTarget: types.PatchTarget{
+					Gvk:       gvk.Gvk{Group: "apps", Version: "v1", Kind: "Deployment"},
+					Namespace: "default",
+					Name:      "test-deployment",
+				},
+			},
+			Up: []Patch{
+				{
+					Type:   "application/json-patch+json",
+					Change: `[{"op":"replace","path":"/spec/template/spec/containers/0/image","value":"app:v2"}]`,
+				},
+			},
+			Verify: &Verification{RollbackOnFailure: true},
+		},
+	}
+	fc := fake.NewClientBuilder().WithObjects(newDeployment(withAvailable(corev1.ConditionFalse))).Build()
+
+	err := MigrateUp(context.TODO(), fc, migrations)
+
+	assert.EqualError(t, err, "migration update-image: verify.rollbackOnFailure requires down patches")
+	var deployment appsv1.Deployment
+	if err := fc.Get(context.TODO(), client.ObjectKey{Name: "test-deployment", Namespace: "default"}, &deployment); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "app:v1", deployment.Spec.Template.Spec.Containers[0].Image)
+}
+
+func withAvailable(status corev1.ConditionStatus) func(*appsv1.Deployment) {
+	return func(d *appsv1.Deployment) {
+		d.SetGeneration(2)
+		d.Status = appsv1.DeploymentStatus{
+			ObservedGeneration: 2,
+			ReadyReplicas:      1,
+			Conditions: []appsv1.DeploymentCondition{
+				{Type: appsv1.DeploymentAvailable, Status: status},
+			},
+		}
+	}
+}